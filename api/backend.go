@@ -0,0 +1,84 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// ErrNotFound is returned by backends if the tag does not exist.
+var ErrNotFound = errors.New("not found")
+
+const (
+	BackendRegistry = "registry"
+	BackendDir      = "dir"
+	BackendOCI      = "oci"
+)
+
+// Backend stores cache images by tag.
+type Backend interface {
+	// Get returns the image of tag, the error matches ErrNotFound if tag does not exist.
+	Get(ctx context.Context, tag string) (v1.Image, error)
+	Put(ctx context.Context, tag string, img v1.Image) error
+	// Exists returns the digest of the image of tag, ok is false if tag does not exist.
+	Exists(ctx context.Context, tag string) (digest v1.Hash, ok bool, err error)
+	List(ctx context.Context) ([]string, error)
+	Delete(ctx context.Context, tag string) error
+	// Reference returns a readable location of tag.
+	Reference(tag string) string
+}
+
+// backendSchemes maps repository prefixes to backend types, the prefix is trimmed.
+var backendSchemes = []struct {
+	prefix  string
+	backend string
+}{
+	{"docker://", BackendRegistry},
+	{"oci:", BackendOCI},
+	{"dir:", BackendDir},
+}
+
+// parseRepository splits repository into backend type and location, backend is empty if
+// repository has no scheme.
+func parseRepository(repo string) (backend string, location string) {
+	for _, s := range backendSchemes {
+		if strings.HasPrefix(repo, s.prefix) {
+			return s.backend, strings.TrimPrefix(repo, s.prefix)
+		}
+	}
+	return "", repo
+}
+
+func (o *options) storage() (Backend, error) {
+	if o.backend != nil {
+		return o.backend, nil
+	}
+
+	backend, location := parseRepository(o.repo)
+	if len(backend) != 0 && len(o.backendType) != 0 && backend != o.backendType {
+		return nil, fmt.Errorf("backend \"%s\" conflicts with repository \"%s\"", o.backendType, o.repo)
+	}
+	if len(backend) == 0 {
+		backend = o.backendType
+	}
+
+	switch backend {
+	case "", BackendRegistry:
+		return &registryBackend{o: o}, nil
+	case BackendDir:
+		if len(location) == 0 {
+			return nil, fmt.Errorf("repository is required by backend \"%s\"", backend)
+		}
+		return &dirBackend{dir: location}, nil
+	case BackendOCI:
+		if len(location) == 0 {
+			return nil, fmt.Errorf("repository is required by backend \"%s\"", backend)
+		}
+		return &ociBackend{dir: location}, nil
+	default:
+		return nil, fmt.Errorf("backend \"%s\" is invalid", backend)
+	}
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/ssuf1998dev/container-registry-as-cache/internal/utils"
+)
+
+const dirBackendExt = ".tar"
+
+// dirBackend stores each cache image as "<tag>.tar" in a directory, the same format as "--output".
+type dirBackend struct {
+	dir string
+}
+
+func (b *dirBackend) file(tag string) (string, error) {
+	if len(tag) == 0 || strings.ContainsAny(tag, `/\`) || tag == "." || tag == ".." {
+		return "", fmt.Errorf("tag \"%s\" is invalid", tag)
+	}
+	return filepath.Join(b.dir, tag+dirBackendExt), nil
+}
+
+func (b *dirBackend) Get(_ context.Context, tag string) (v1.Image, error) {
+	file, err := b.file(tag)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w, \"%s\"", ErrNotFound, file)
+	}
+	return tarball.ImageFromPath(file, nil)
+}
+
+func (b *dirBackend) Put(_ context.Context, tag string, img v1.Image) error {
+	file, err := b.file(tag)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(b.dir, 0755); err != nil {
+		return err
+	}
+	ref, err := name.NewTag(fmt.Sprintf("%s:%s", utils.Crac, tag))
+	if err != nil {
+		return err
+	}
+	// written next to the final file then renamed, readers never see a partial image
+	f, err := os.CreateTemp(b.dir, fmt.Sprintf(".%s.*", tag))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := tarball.Write(ref, img, f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), file)
+}
+
+func (b *dirBackend) Exists(ctx context.Context, tag string) (v1.Hash, bool, error) {
+	img, err := b.Get(ctx, tag)
+	if err != nil {
+		if isNotFound(err) {
+			return v1.Hash{}, false, nil
+		}
+		return v1.Hash{}, false, err
+	}
+	digest, err := img.Digest()
+	return digest, err == nil, err
+}
+
+func (b *dirBackend) List(_ context.Context) ([]string, error) {
+	entries, err := os.ReadDir(b.dir)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	tags := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || filepath.Ext(entry.Name()) != dirBackendExt {
+			continue
+		}
+		tags = append(tags, strings.TrimSuffix(entry.Name(), dirBackendExt))
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+func (b *dirBackend) Delete(_ context.Context, tag string) error {
+	file, err := b.file(tag)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(file); os.IsNotExist(err) {
+		return fmt.Errorf("%w, \"%s\"", ErrNotFound, file)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (b *dirBackend) Reference(tag string) string {
+	file, err := b.file(tag)
+	if err != nil {
+		return tag
+	}
+	if abs, err := filepath.Abs(file); err == nil {
+		file = abs
+	}
+	return fmt.Sprintf("dir:%s", file)
+}
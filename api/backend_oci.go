@@ -0,0 +1,188 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/match"
+)
+
+const ociRefName = "org.opencontainers.image.ref.name"
+
+// ociGCGrace keeps blobs written recently when collecting garbage, they may belong to
+// an image being written.
+const ociGCGrace = time.Hour
+
+// ociBackend stores cache images in an OCI image layout, tags are the ref name annotations
+// in index.json. Blobs only referenced by deleted images are removed on deleting.
+type ociBackend struct {
+	dir string
+}
+
+// path opens the layout, it is created if create is true and it does not exist.
+func (b *ociBackend) path(create bool) (layout.Path, bool, error) {
+	p, err := layout.FromPath(b.dir)
+	if err == nil {
+		return p, true, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", false, err
+	}
+	if !create {
+		return "", false, nil
+	}
+	p, err = layout.Write(b.dir, empty.Index)
+	return p, err == nil, err
+}
+
+func (b *ociBackend) descriptor(tag string) (layout.Path, *v1.Descriptor, error) {
+	p, ok, err := b.path(false)
+	if err != nil || !ok {
+		return p, nil, err
+	}
+	ii, err := p.ImageIndex()
+	if err != nil {
+		return p, nil, err
+	}
+	im, err := ii.IndexManifest()
+	if err != nil {
+		return p, nil, err
+	}
+	matcher := match.Name(tag)
+	for i := len(im.Manifests) - 1; i >= 0; i-- {
+		if matcher(im.Manifests[i]) {
+			return p, &im.Manifests[i], nil
+		}
+	}
+	return p, nil, nil
+}
+
+func (b *ociBackend) Get(_ context.Context, tag string) (v1.Image, error) {
+	p, desc, err := b.descriptor(tag)
+	if err != nil {
+		return nil, err
+	}
+	if desc == nil {
+		return nil, fmt.Errorf("%w, tag \"%s\" in \"%s\"", ErrNotFound, tag, b.dir)
+	}
+	return p.Image(desc.Digest)
+}
+
+func (b *ociBackend) Put(_ context.Context, tag string, img v1.Image) error {
+	p, _, err := b.path(true)
+	if err != nil {
+		return err
+	}
+	return p.ReplaceImage(img, match.Name(tag), layout.WithAnnotations(map[string]string{ociRefName: tag}))
+}
+
+func (b *ociBackend) Exists(_ context.Context, tag string) (v1.Hash, bool, error) {
+	_, desc, err := b.descriptor(tag)
+	if err != nil || desc == nil {
+		return v1.Hash{}, false, err
+	}
+	return desc.Digest, true, nil
+}
+
+func (b *ociBackend) List(_ context.Context) ([]string, error) {
+	p, ok, err := b.path(false)
+	if err != nil || !ok {
+		return []string{}, err
+	}
+	ii, err := p.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	im, err := ii.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	tags := []string{}
+	for _, desc := range im.Manifests {
+		if tag, ok := desc.Annotations[ociRefName]; ok {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+func (b *ociBackend) Delete(_ context.Context, tag string) error {
+	p, desc, err := b.descriptor(tag)
+	if err != nil {
+		return err
+	}
+	if desc == nil {
+		return fmt.Errorf("%w, tag \"%s\" in \"%s\"", ErrNotFound, tag, b.dir)
+	}
+	if err := p.RemoveDescriptors(match.Name(tag)); err != nil {
+		return err
+	}
+	return b.gc(p)
+}
+
+// gc removes blobs not referenced by images in index.json.
+func (b *ociBackend) gc(p layout.Path) error {
+	ii, err := p.ImageIndex()
+	if err != nil {
+		return err
+	}
+	im, err := ii.IndexManifest()
+	if err != nil {
+		return err
+	}
+	keep := map[v1.Hash]bool{}
+	for _, desc := range im.Manifests {
+		keep[desc.Digest] = true
+		img, err := ii.Image(desc.Digest)
+		if err != nil {
+			// not an image, keep everything to be safe
+			return nil
+		}
+		m, err := img.Manifest()
+		if err != nil {
+			return err
+		}
+		keep[m.Config.Digest] = true
+		for _, layer := range m.Layers {
+			keep[layer.Digest] = true
+		}
+	}
+
+	algorithms, err := os.ReadDir(filepath.Join(b.dir, "blobs"))
+	if err != nil {
+		return err
+	}
+	for _, algorithm := range algorithms {
+		blobs, err := os.ReadDir(filepath.Join(b.dir, "blobs", algorithm.Name()))
+		if err != nil {
+			continue
+		}
+		for _, blob := range blobs {
+			h := v1.Hash{Algorithm: algorithm.Name(), Hex: blob.Name()}
+			fi, err := blob.Info()
+			if keep[h] || err != nil || time.Since(fi.ModTime()) < ociGCGrace {
+				continue
+			}
+			if err := p.RemoveBlob(h); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (b *ociBackend) Reference(tag string) string {
+	dir, err := filepath.Abs(b.dir)
+	if err != nil {
+		dir = b.dir
+	}
+	return fmt.Sprintf("oci:%s:%s", dir, tag)
+}
@@ -0,0 +1,137 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackend(t *testing.T) {
+	foo, _ := filepath.Abs("../testdata/foo")
+
+	for _, repo := range []string{
+		"dir:" + filepath.Join(t.TempDir(), "cache"),
+		"oci:" + filepath.Join(t.TempDir(), "cache"),
+		"docker://" + newTestRegistry(t, false),
+	} {
+		t.Run(repo, func(t *testing.T) {
+			common := []Option{
+				WithContext(t.Context()),
+				WithRepository(repo),
+				WithForceHttp(true),
+				WithDepFiles(map[string]string{"../testdata/foo": foo}),
+			}
+
+			pushed, err := PushWithResult(append(common, WithFiles(map[string]string{"foo": foo}), WithForcePush(false))...)
+			require.NoError(t, err)
+			assert.Equal(t, StatusPushed, pushed.Status)
+
+			skipped, err := PushWithResult(append(common, WithFiles(map[string]string{"foo": foo}), WithForcePush(false))...)
+			require.NoError(t, err)
+			assert.Equal(t, StatusSkipped, skipped.Status)
+			assert.Equal(t, pushed.Digest, skipped.Digest)
+
+			workdir := t.TempDir()
+			hit, err := PullWithResult(append(common, WithWorkdir(workdir))...)
+			require.NoError(t, err)
+			assert.Equal(t, StatusHit, hit.Status)
+			assert.Equal(t, pushed.Digest, hit.Digest)
+			b, err := os.ReadFile(filepath.Join(workdir, "foo"))
+			require.NoError(t, err)
+			assert.Equal(t, "bar", string(b))
+
+			partial, err := PullWithResult(append(common,
+				WithKeys([]string{"changed"}),
+				WithRestoreKeys([]string{pushed.Tag}),
+				WithWorkdir(t.TempDir()),
+			)...)
+			require.NoError(t, err)
+			assert.Equal(t, StatusPartial, partial.Status)
+
+			backend, err := newOptions(common...).storage()
+			require.NoError(t, err)
+			tags, err := backend.List(t.Context())
+			require.NoError(t, err)
+			assert.Equal(t, []string{pushed.Tag}, tags)
+
+			require.NoError(t, backend.Delete(t.Context(), pushed.Tag))
+			_, ok, err := backend.Exists(t.Context(), pushed.Tag)
+			require.NoError(t, err)
+			assert.False(t, ok)
+			_, err = backend.Get(t.Context(), pushed.Tag)
+			require.ErrorIs(t, err, ErrNotFound)
+
+			_, err = PullWithResult(append(common, WithWorkdir(t.TempDir()))...)
+			require.ErrorIs(t, err, ErrCacheMiss)
+		})
+	}
+}
+
+func TestBackend_Type(t *testing.T) {
+	dir := t.TempDir()
+
+	backend, err := newOptions(WithRepository(dir), WithBackendType(BackendDir)).storage()
+	require.NoError(t, err)
+	assert.IsType(t, &dirBackend{}, backend)
+
+	backend, err = newOptions(WithRepository("oci:"+dir), WithBackendType(BackendOCI)).storage()
+	require.NoError(t, err)
+	assert.IsType(t, &ociBackend{}, backend)
+
+	backend, err = newOptions(WithRepository("127.0.0.1:5000/crac")).storage()
+	require.NoError(t, err)
+	assert.IsType(t, &registryBackend{}, backend)
+
+	_, err = newOptions(WithRepository("oci:"+dir), WithBackendType(BackendDir)).storage()
+	require.Error(t, err)
+	_, err = newOptions(WithRepository(dir), WithBackendType("s3")).storage()
+	require.Error(t, err)
+	_, err = newOptions(WithBackendType(BackendOCI)).storage()
+	require.Error(t, err)
+}
+
+func TestBlobCache(t *testing.T) {
+	foo, _ := filepath.Abs("../testdata/foo")
+	blobs := t.TempDir()
+	common := []Option{
+		WithContext(t.Context()),
+		WithRepository(newTestRegistry(t, false)),
+		WithForceHttp(true),
+		WithDepFiles(map[string]string{"../testdata/foo": foo}),
+		WithBlobCache(blobs, 0),
+	}
+
+	_, err := PushWithResult(append(common, WithFiles(map[string]string{"foo": foo}))...)
+	require.NoError(t, err)
+	entries, err := os.ReadDir(filepath.Join(blobs, "sha256"))
+	require.NoError(t, err)
+	assert.NotEmpty(t, entries)
+
+	// the first pull fills the blob cache, the second one reads from it
+	require.NoError(t, os.RemoveAll(blobs))
+	for range 2 {
+		workdir := t.TempDir()
+		hit, err := PullWithResult(append(common, WithWorkdir(workdir))...)
+		require.NoError(t, err)
+		assert.Equal(t, StatusHit, hit.Status)
+		b, err := os.ReadFile(filepath.Join(workdir, "foo"))
+		require.NoError(t, err)
+		assert.Equal(t, "bar", string(b))
+		entries, err := os.ReadDir(filepath.Join(blobs, "sha256"))
+		require.NoError(t, err)
+		assert.Len(t, entries, 1)
+	}
+
+	// other backends are on disk already
+	dir := filepath.Join(t.TempDir(), "cache")
+	blobs = t.TempDir()
+	_, err = PushWithResult(append(common[:len(common)-1],
+		WithRepository("dir:"+dir), WithFiles(map[string]string{"foo": foo}), WithBlobCache(blobs, 0),
+	)...)
+	require.NoError(t, err)
+	entries, _ = os.ReadDir(blobs)
+	assert.Empty(t, entries)
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"log/slog"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/ssuf1998dev/container-registry-as-cache/internal/utils"
+)
+
+// deltaBase is the cache image a delta layer is stacked on.
+type deltaBase struct {
+	tag       string
+	layers    []v1.Layer
+	meta      *utils.CracMeta
+	checksums map[string]string
+	entries   map[string]utils.EntryMeta
+}
+
+func (o *options) maxDepthOrDefault() int {
+	if o.maxDepth <= 0 {
+		return utils.DefaultMaxDepth
+	}
+	return o.maxDepth
+}
+
+// resolveBase finds the cache image of WithBase, nil means a full cache image is pushed, since
+// there is no such cache image, it is pushed by an older version without checksums or entries,
+// it is of another platform, or the chain is too deep and gets compacted.
+func (o *options) resolveBase(backend Backend) (*deltaBase, error) {
+	if len(o.base) == 0 {
+		return nil, nil
+	}
+	tag := o.base
+	img, err := backend.Get(o.context, tag)
+	if err != nil {
+		if !isNotFound(err) {
+			return nil, err
+		}
+		slog.Debug("base tag not found, looking up as a prefix", "base", o.base)
+		if tag, err = o.findNewestTag(backend, []string{o.base}); err != nil {
+			return nil, err
+		}
+		if len(tag) == 0 {
+			slog.Info("base not found, pushing full layers", "base", o.base)
+			return nil, nil
+		}
+		if img, err = backend.Get(o.context, tag); err != nil {
+			return nil, err
+		}
+	}
+
+	entry, err := describe(backend, tag, img)
+	if err != nil {
+		return nil, err
+	}
+	meta := entry.meta
+	if meta.Platform != o.platform {
+		slog.Warn("base is of another platform, pushing full layers", "base", tag, "platform", meta.Platform)
+		return nil, nil
+	}
+	if meta.Depth+1 > o.maxDepthOrDefault() {
+		slog.Info("base reaches max depth, compacting into full layers", "base", tag, "depth", meta.Depth)
+		return nil, nil
+	}
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	checksums, err := readChecksums(img, cf, meta)
+	if err != nil {
+		return nil, err
+	}
+	if checksums == nil {
+		slog.Warn("base has no checksums, pushing full layers", "base", tag)
+		return nil, nil
+	}
+	entries, err := readEntries(img, cf)
+	if err != nil {
+		return nil, err
+	}
+	if entries == nil {
+		slog.Warn("base has no entries, pushing full layers", "base", tag)
+		return nil, nil
+	}
+	layers, err := cacheLayers(img)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("base found", "base", tag, "depth", meta.Depth, "layers", len(layers))
+	return &deltaBase{tag: tag, layers: layers, meta: meta, checksums: checksums, entries: entries}, nil
+}
@@ -0,0 +1,158 @@
+package api
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/ssuf1998dev/container-registry-as-cache/internal/utils"
+)
+
+const (
+	DiffSame    = "same"
+	DiffChanged = "changed"
+	// DiffAdded means only the local inputs have it.
+	DiffAdded = "added"
+	// DiffRemoved means only the reference cache image has it.
+	DiffRemoved = "removed"
+)
+
+const (
+	DiffKindHashScheme = "hash scheme"
+	DiffKindPrefix     = "prefix"
+	DiffKindPlatform   = "platform"
+	DiffKindKey        = "key"
+	DiffKindDepFile    = "dep file"
+)
+
+// Explanation compares the local key components with the ones recorded in a cache image.
+type Explanation struct {
+	// Tag is the tag pushing or pulling would use.
+	Tag  string `json:"tag"`
+	Hash string `json:"hash"`
+	// Reference is the cache image compared with.
+	Reference *Entry `json:"reference"`
+	// Match tells whether the untruncated hashes equal.
+	Match bool         `json:"match"`
+	Diffs []*InputDiff `json:"diffs"`
+	// Incomplete tells the reference cache image is pushed by an older version, which does not
+	// record dep files, or even keys and the platform, so changes of what it lacks are unknown.
+	Incomplete bool `json:"incomplete"`
+}
+
+type InputDiff struct {
+	Kind      string `json:"kind"`
+	Name      string `json:"name,omitempty"`
+	Status    string `json:"status"`
+	Local     string `json:"local,omitempty"`
+	Reference string `json:"reference,omitempty"`
+}
+
+// Changed returns diffs whose status is not DiffSame.
+func (e *Explanation) Changed() []*InputDiff {
+	return slices.DeleteFunc(slices.Clone(e.Diffs), func(d *InputDiff) bool { return d.Status == DiffSame })
+}
+
+// Explain tells why a cache missed by comparing keys, dep file hashes, the platform and the tag
+// prefix with the meta of the cache image tagged by WithTag, or the newest one starting with
+// the tag prefix if no tag is set.
+func Explain(opts ...Option) (*Explanation, error) {
+	o := newOptions(opts...)
+	backend, err := o.storage()
+	if err != nil {
+		return nil, err
+	}
+	hash, _, err := o.computeHash()
+	if err != nil {
+		return nil, err
+	}
+	depFiles, err := utils.HashDepFiles(o.depFiles, o.workdir)
+	if err != nil {
+		return nil, err
+	}
+	explanation := &Explanation{Tag: o.joinTag(hash), Hash: hash}
+
+	var reference *Entry
+	if len(o.tag) != 0 {
+		img, err := backend.Get(o.context, o.tag)
+		if err != nil {
+			return nil, err
+		}
+		if reference, err = describe(backend, o.tag, img); err != nil {
+			return nil, err
+		}
+	} else {
+		entries, err := o.list(backend)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 {
+			return nil, fmt.Errorf("%w, no cache image to compare with", ErrCacheMiss)
+		}
+		reference = entries[0]
+	}
+	explanation.Reference = reference
+	meta := reference.meta
+	scheme := meta.HashSchemeOrDefault()
+	explanation.Match = len(hash) != 0 && hash == meta.Hash && o.hashSchemeOrDefault() == scheme
+	explanation.Incomplete = !meta.RecordsInputs()
+	// the oldest versions record neither keys nor the platform, which would all look added
+	inputsUnknown := explanation.Incomplete && len(meta.Keys) == 0 && len(meta.Platform) == 0
+
+	explanation.Diffs = append(explanation.Diffs, diffValue(DiffKindHashScheme, "", o.hashSchemeOrDefault(), scheme))
+	prefix, _ := utils.SplitTag(reference.Tag)
+	localPrefix, _ := utils.SplitTag(explanation.Tag)
+	explanation.Diffs = append(explanation.Diffs, diffValue(DiffKindPrefix, "", localPrefix, prefix))
+	if inputsUnknown {
+		return explanation, nil
+	}
+	explanation.Diffs = append(explanation.Diffs, diffValue(DiffKindPlatform, "", o.platform, meta.Platform))
+
+	for _, k := range o.keys {
+		if slices.Contains(meta.Keys, k) {
+			explanation.Diffs = append(explanation.Diffs, &InputDiff{Kind: DiffKindKey, Name: k, Status: DiffSame, Local: k, Reference: k})
+		} else {
+			explanation.Diffs = append(explanation.Diffs, &InputDiff{Kind: DiffKindKey, Name: k, Status: DiffAdded, Local: k})
+		}
+	}
+	for _, k := range meta.Keys {
+		if !slices.Contains(o.keys, k) {
+			explanation.Diffs = append(explanation.Diffs, &InputDiff{Kind: DiffKindKey, Name: k, Status: DiffRemoved, Reference: k})
+		}
+	}
+
+	if explanation.Incomplete {
+		return explanation, nil
+	}
+	refFiles := map[string]string{}
+	for _, f := range meta.DepFiles {
+		refFiles[f.Path] = f.Sha256
+	}
+	for _, f := range depFiles {
+		sum, ok := refFiles[f.Path]
+		delete(refFiles, f.Path)
+		if !ok {
+			explanation.Diffs = append(explanation.Diffs, &InputDiff{Kind: DiffKindDepFile, Name: f.Path, Status: DiffAdded, Local: f.Sha256})
+			continue
+		}
+		explanation.Diffs = append(explanation.Diffs, diffValue(DiffKindDepFile, f.Path, f.Sha256, sum))
+	}
+	for _, path := range slices.Sorted(maps.Keys(refFiles)) {
+		explanation.Diffs = append(explanation.Diffs, &InputDiff{Kind: DiffKindDepFile, Name: path, Status: DiffRemoved, Reference: refFiles[path]})
+	}
+	return explanation, nil
+}
+
+func diffValue(kind string, name string, local string, reference string) *InputDiff {
+	d := &InputDiff{Kind: kind, Name: name, Status: DiffSame, Local: local, Reference: reference}
+	switch {
+	case local == reference:
+	case len(local) == 0:
+		d.Status = DiffRemoved
+	case len(reference) == 0:
+		d.Status = DiffAdded
+	default:
+		d.Status = DiffChanged
+	}
+	return d
+}
@@ -0,0 +1,168 @@
+package api
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/goccy/go-yaml"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/ssuf1998dev/container-registry-as-cache/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExplain(t *testing.T) {
+	dir := t.TempDir()
+	lock, other := filepath.Join(dir, "lock"), filepath.Join(dir, "other")
+	require.NoError(t, os.WriteFile(lock, []byte("v1"), 0644))
+	require.NoError(t, os.WriteFile(other, []byte("v1"), 0644))
+	foo := filepath.Join(dir, "foo")
+	require.NoError(t, os.WriteFile(foo, []byte("bar"), 0644))
+
+	repo := "dir:" + filepath.Join(t.TempDir(), "cache")
+	common := []Option{
+		WithContext(t.Context()),
+		WithRepository(repo),
+		WithTagPrefix("app"),
+		WithPlatform("linux/amd64"),
+		WithWorkdir(dir),
+	}
+	pushed, err := PushWithResult(append(common,
+		WithKeys([]string{"a", "b"}),
+		WithDepFiles(map[string]string{"lock": lock, "other": other}),
+		WithFiles(map[string]string{"foo": foo}),
+	)...)
+	require.NoError(t, err)
+
+	explanation, err := Explain(append(common,
+		WithKeys([]string{"a", "b"}),
+		WithDepFiles(map[string]string{"lock": lock, "other": other}),
+	)...)
+	require.NoError(t, err)
+	assert.Equal(t, pushed.Tag, explanation.Tag)
+	assert.Equal(t, pushed.Tag, explanation.Reference.Tag)
+	assert.True(t, explanation.Match)
+	assert.False(t, explanation.Incomplete)
+	assert.Empty(t, explanation.Changed())
+
+	require.NoError(t, os.WriteFile(lock, []byte("v2"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "new"), []byte("v1"), 0644))
+	explanation, err = Explain(append(common,
+		WithKeys([]string{"a", "c"}),
+		WithDepFiles(map[string]string{"lock": lock, "new": filepath.Join(dir, "new")}),
+	)...)
+	require.NoError(t, err)
+	assert.False(t, explanation.Match)
+	assert.NotEqual(t, pushed.Tag, explanation.Tag)
+	changed := map[string]string{}
+	for _, d := range explanation.Changed() {
+		changed[d.Kind+":"+d.Name] = d.Status
+	}
+	assert.Equal(t, map[string]string{
+		"key:c":          DiffAdded,
+		"key:b":          DiffRemoved,
+		"dep file:lock":  DiffChanged,
+		"dep file:new":   DiffAdded,
+		"dep file:other": DiffRemoved,
+	}, changed)
+
+	explanation, err = Explain(append(common, WithTag(pushed.Tag), WithTagPrefix("web"), WithPlatform("linux/arm64"))...)
+	require.NoError(t, err)
+	changed = map[string]string{}
+	for _, d := range explanation.Changed() {
+		changed[d.Kind+":"+d.Name] = d.Status
+	}
+	assert.Equal(t, DiffChanged, changed["prefix:"])
+	assert.Equal(t, DiffChanged, changed["platform:"])
+
+	require.NoError(t, os.WriteFile(lock, []byte("v1"), 0644))
+	explanation, err = Explain(append(common,
+		WithKeys([]string{"a", "b"}),
+		WithDepFiles(map[string]string{"lock": lock, "other": other}),
+		WithTag(pushed.Tag),
+		WithHashScheme(utils.HashSchemeV2),
+	)...)
+	require.NoError(t, err)
+	assert.False(t, explanation.Match)
+	assert.Equal(t, []*InputDiff{{
+		Kind: DiffKindHashScheme, Status: DiffChanged, Local: utils.HashSchemeV2, Reference: utils.HashSchemeV1,
+	}}, explanation.Changed())
+
+	_, err = Explain(append(common, WithTagPrefix("none"))...)
+	require.ErrorIs(t, err, ErrCacheMiss)
+}
+
+func TestExplain_Tag(t *testing.T) {
+	dir := t.TempDir()
+	lock := filepath.Join(dir, "lock")
+	require.NoError(t, os.WriteFile(lock, []byte("v1"), 0644))
+	foo := filepath.Join(dir, "foo")
+	require.NoError(t, os.WriteFile(foo, []byte("bar"), 0644))
+
+	common := []Option{
+		WithContext(t.Context()),
+		WithRepository("dir:" + filepath.Join(t.TempDir(), "cache")),
+		WithTag("main"),
+		WithPlatform("linux/amd64"),
+		WithWorkdir(dir),
+		WithKeys([]string{"a"}),
+		WithDepFiles(map[string]string{"lock": lock}),
+	}
+	// a tagged push records dep files but no hash
+	_, err := PushWithResult(append(common, WithFiles(map[string]string{"foo": foo}))...)
+	require.NoError(t, err)
+
+	explanation, err := Explain(common...)
+	require.NoError(t, err)
+	assert.False(t, explanation.Incomplete)
+	assert.Empty(t, explanation.Changed())
+
+	require.NoError(t, os.WriteFile(lock, []byte("v2"), 0644))
+	explanation, err = Explain(common...)
+	require.NoError(t, err)
+	assert.False(t, explanation.Incomplete)
+	require.Len(t, explanation.Changed(), 1)
+	assert.Equal(t, DiffKindDepFile, explanation.Changed()[0].Kind)
+	assert.Equal(t, DiffChanged, explanation.Changed()[0].Status)
+}
+
+func TestExplain_NoHashScheme(t *testing.T) {
+	foo, _ := filepath.Abs("../testdata/foo")
+	common := []Option{
+		WithContext(t.Context()),
+		WithRepository("dir:" + filepath.Join(t.TempDir(), "cache")),
+		WithDepFiles(map[string]string{"../testdata/foo": foo}),
+	}
+	pushed, err := PushWithResult(append(common, WithFiles(map[string]string{"foo": foo}))...)
+	require.NoError(t, err)
+
+	// drop the hash scheme like versions before schemes did
+	backend, err := newOptions(common...).storage()
+	require.NoError(t, err)
+	img, err := backend.Get(t.Context(), pushed.Tag)
+	require.NoError(t, err)
+	cf, _ := img.ConfigFile()
+	meta, err := readMeta(img, cf)
+	require.NoError(t, err)
+	meta.HashScheme = ""
+	metaData, err := yaml.Marshal(meta)
+	require.NoError(t, err)
+	metaLayer, err := crane.Layer(map[string][]byte{fmt.Sprintf("/%s/meta.yaml", utils.Crac): metaData})
+	require.NoError(t, err)
+	layers, _ := img.Layers()
+	old, err := mutate.Append(empty.Image,
+		mutate.Addendum{Layer: layers[0], History: cf.History[0]},
+		mutate.Addendum{Layer: metaLayer, History: cf.History[1]},
+	)
+	require.NoError(t, err)
+	require.NoError(t, backend.Put(t.Context(), pushed.Tag, old))
+
+	explanation, err := Explain(common...)
+	require.NoError(t, err)
+	assert.True(t, explanation.Match)
+	assert.Empty(t, explanation.Changed())
+}
@@ -0,0 +1,144 @@
+package api
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-yaml"
+	"github.com/ssuf1998dev/container-registry-as-cache/internal/tarhelper"
+)
+
+// Inspection tells what a cache image is, nothing is extracted to disk.
+type Inspection struct {
+	Entry
+	Exact   bool             `json:"exact"`
+	Meta    map[string]any   `json:"meta"`
+	History []InspectHistory `json:"history"`
+	Layers  []InspectLayer   `json:"layers"`
+	// Files is only listed with WithListFiles.
+	Files []InspectFile `json:"files,omitempty"`
+}
+
+type InspectHistory struct {
+	Created   time.Time `json:"created"`
+	CreatedBy string    `json:"createdBy"`
+}
+
+type InspectLayer struct {
+	Digest    string `json:"digest"`
+	DiffID    string `json:"diffId"`
+	MediaType string `json:"mediaType"`
+	Size      int64  `json:"size"`
+	CreatedBy string `json:"createdBy,omitempty"`
+}
+
+type InspectFile struct {
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	Size     int64     `json:"size"`
+	Mode     string    `json:"mode"`
+	ModTime  time.Time `json:"modTime,omitzero"`
+	Linkname string    `json:"linkname,omitempty"`
+}
+
+// Inspect resolves the tag the same way pulling does, then reads the meta, history and layers.
+func Inspect(opts ...Option) (*Inspection, error) {
+	o := newOptions(opts...)
+	tag, _, err := o.computeTag()
+	if err != nil {
+		return nil, err
+	}
+	backend, err := o.storage()
+	if err != nil {
+		return nil, err
+	}
+	tag, exact, img, err := o.resolve(backend, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := describe(backend, tag, img)
+	if err != nil {
+		return nil, err
+	}
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	inspection := &Inspection{Entry: *entry, Exact: exact, Meta: map[string]any{}}
+
+	metaData, err := readMetaData(img, cf)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(metaData, &inspection.Meta); err != nil {
+		return nil, fmt.Errorf("invalid, meta is not yaml, %s", err)
+	}
+
+	for _, h := range cf.History {
+		inspection.History = append(inspection.History, InspectHistory{Created: h.Created.Time, CreatedBy: h.CreatedBy})
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	for i, layer := range layers {
+		il := InspectLayer{}
+		if digest, err := layer.Digest(); err == nil {
+			il.Digest = digest.String()
+		}
+		if diffID, err := layer.DiffID(); err == nil {
+			il.DiffID = diffID.String()
+		}
+		if mediaType, err := layer.MediaType(); err == nil {
+			il.MediaType = string(mediaType)
+		}
+		il.Size, _ = layer.Size()
+		if i < len(cf.History) {
+			il.CreatedBy = cf.History[i].CreatedBy
+		}
+		inspection.Layers = append(inspection.Layers, il)
+	}
+
+	if !o.listFiles {
+		return inspection, nil
+	}
+	cache, err := cacheLayers(img)
+	if err != nil {
+		return nil, err
+	}
+	rc := flattenLayers(cache, entry.meta.Depth)
+	defer rc.Close()
+	inspection.Files = []InspectFile{}
+	err = tarhelper.WalkTar(rc, func(header *tar.Header, fi os.FileInfo, r io.Reader) (bool, error) {
+		inspection.Files = append(inspection.Files, InspectFile{
+			Name:     strings.TrimSuffix(header.Name, "/"),
+			Type:     typeName(header.Typeflag),
+			Size:     header.Size,
+			Mode:     fi.Mode().String(),
+			ModTime:  header.ModTime,
+			Linkname: header.Linkname,
+		})
+		return false, nil
+	})
+	return inspection, err
+}
+
+func typeName(flag byte) string {
+	switch flag {
+	case tar.TypeReg:
+		return "file"
+	case tar.TypeDir:
+		return "dir"
+	case tar.TypeSymlink:
+		return "symlink"
+	case tar.TypeLink:
+		return "hardlink"
+	default:
+		return fmt.Sprintf("other(%c)", flag)
+	}
+}
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/ssuf1998dev/container-registry-as-cache/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspect(t *testing.T) {
+	repo := newTestRegistry(t, false)
+	foo, _ := filepath.Abs("../testdata/foo")
+	common := []Option{
+		WithContext(t.Context()),
+		WithRepository(repo),
+		WithForceHttp(true),
+		WithDepFiles(map[string]string{"../testdata/foo": foo}),
+		WithKeys([]string{"a"}),
+	}
+	pushed, err := PushWithResult(append(common, WithFiles(map[string]string{"foo": foo}))...)
+	require.NoError(t, err)
+
+	inspection, err := Inspect(common...)
+	require.NoError(t, err)
+	assert.Equal(t, pushed.Tag, inspection.Tag)
+	assert.Equal(t, pushed.Digest, inspection.Digest)
+	assert.True(t, inspection.Exact)
+	assert.Equal(t, utils.CracVersion.String(), inspection.Meta["version"])
+	require.Len(t, inspection.History, 2)
+	assert.Equal(t, utils.CreatedByCracCopy, inspection.History[0].CreatedBy)
+	require.Len(t, inspection.Layers, 2)
+	assert.Equal(t, utils.CreatedByCracCopy, inspection.Layers[0].CreatedBy)
+	assert.Nil(t, inspection.Files)
+
+	inspection, err = Inspect(append(common, WithListFiles(true))...)
+	require.NoError(t, err)
+	require.Len(t, inspection.Files, 1)
+	assert.Equal(t, "foo", inspection.Files[0].Name)
+	assert.Equal(t, "file", inspection.Files[0].Type)
+	assert.Equal(t, int64(3), inspection.Files[0].Size)
+
+	inspection, err = Inspect(append(common, WithKeys([]string{"b"}), WithRestoreKeys([]string{pushed.Tag}))...)
+	require.NoError(t, err)
+	assert.False(t, inspection.Exact)
+	assert.Equal(t, pushed.Tag, inspection.Tag)
+
+	_, err = Inspect(append(common, WithKeys([]string{"b"}))...)
+	require.ErrorIs(t, err, ErrCacheMiss)
+}
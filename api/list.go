@@ -0,0 +1,195 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-yaml"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/ssuf1998dev/container-registry-as-cache/internal/tarhelper"
+	"github.com/ssuf1998dev/container-registry-as-cache/internal/utils"
+)
+
+// listConcurrency caps images described at the same time by List.
+const listConcurrency = 8
+
+// Entry describes a cache image in a repository.
+type Entry struct {
+	Tag       string    `json:"tag"`
+	Reference string    `json:"reference"`
+	Digest    string    `json:"digest"`
+	Created   time.Time `json:"created"`
+	// Size is the compressed size of all layers.
+	Size     int64    `json:"size"`
+	Version  string   `json:"version"`
+	Keys     []string `json:"keys,omitempty"`
+	Platform string   `json:"platform,omitempty"`
+
+	// compressed sizes of layers by digest
+	layers map[string]int64
+	meta   *utils.CracMeta
+}
+
+func (e *Entry) Age() time.Duration {
+	return time.Since(e.Created).Abs()
+}
+
+// List describes cache images in the repository, newest first. Only tags starting with
+// the tag prefix are listed if it is set, images that are not cache images are skipped.
+func List(opts ...Option) ([]*Entry, error) {
+	o := newOptions(opts...)
+	backend, err := o.storage()
+	if err != nil {
+		return nil, err
+	}
+	return o.list(backend)
+}
+
+func (o *options) list(backend Backend) ([]*Entry, error) {
+	tags, err := backend.List(o.context)
+	if err != nil {
+		return nil, err
+	}
+	if prefix := utils.NormalizeTagPrefix(o.tagPrefix); len(prefix) != 0 {
+		tags = slices.DeleteFunc(tags, func(tag string) bool {
+			return !strings.HasPrefix(tag, prefix)
+		})
+	}
+
+	entries := make([]*Entry, len(tags))
+	sem := make(chan struct{}, listConcurrency)
+	var wg sync.WaitGroup
+	for i, tag := range tags {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			img, err := backend.Get(o.context, tag)
+			if err == nil {
+				entries[i], err = describe(backend, tag, img)
+			}
+			if err != nil {
+				slog.Warn("cache image skipped", "tag", tag, "err", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	entries = slices.DeleteFunc(entries, func(e *Entry) bool { return e == nil })
+	slices.SortStableFunc(entries, func(a, b *Entry) int {
+		return b.Created.Compare(a.Created)
+	})
+	return entries, o.context.Err()
+}
+
+// describe reads the config and the meta of a cache image.
+func describe(backend Backend, tag string, img v1.Image) (*Entry, error) {
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	meta, err := readMeta(img, cf)
+	if err != nil {
+		return nil, err
+	}
+	entry := &Entry{
+		Tag:       tag,
+		Reference: backend.Reference(tag),
+		Created:   cf.Created.Time,
+		Version:   meta.Version,
+		Keys:      meta.Keys,
+		Platform:  meta.Platform,
+		meta:      meta,
+	}
+	if digest, err := img.Digest(); err == nil {
+		entry.Digest = digest.String()
+	}
+	entry.Size, _ = utils.CompressedImageSize(img)
+	entry.layers = map[string]int64{}
+	if layers, err := img.Layers(); err == nil {
+		for _, layer := range layers {
+			digest, err := layer.Digest()
+			if err != nil {
+				continue
+			}
+			entry.layers[digest.String()], _ = layer.Size()
+		}
+	}
+	return entry, nil
+}
+
+// readMeta reads the meta layer found by the CRACMETA history entry.
+func readMeta(img v1.Image, cf *v1.ConfigFile) (*utils.CracMeta, error) {
+	metaData, err := readMetaData(img, cf)
+	if err != nil {
+		return nil, err
+	}
+	var meta utils.CracMeta
+	_ = yaml.Unmarshal(metaData, &meta)
+	return &meta, nil
+}
+
+func readMetaData(img v1.Image, cf *v1.ConfigFile) ([]byte, error) {
+	return readMetaFile(img, cf, "meta.yaml")
+}
+
+// readChecksums reads the per-file checksum manifest, nil if the meta tells there is none.
+func readChecksums(img v1.Image, cf *v1.ConfigFile, meta *utils.CracMeta) (map[string]string, error) {
+	if meta.Files == 0 {
+		return nil, nil
+	}
+	data, err := readMetaFile(img, cf, utils.ChecksumsFile)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, fmt.Errorf("invalid, \"%s\" not found while the meta has %d files", utils.ChecksumsFile, meta.Files)
+	}
+	return utils.ReadChecksums(bytes.NewReader(data))
+}
+
+// readEntries reads the entry list, nil if the cache image is pushed by an older version without it.
+func readEntries(img v1.Image, cf *v1.ConfigFile) (map[string]utils.EntryMeta, error) {
+	data, err := readMetaFile(img, cf, utils.EntriesFile)
+	if err != nil || len(data) == 0 {
+		return nil, err
+	}
+	return utils.ReadEntries(bytes.NewReader(data))
+}
+
+// readMetaFile reads a file of the meta layer, it is nil if the file is not found.
+func readMetaFile(img v1.Image, cf *v1.ConfigFile, file string) ([]byte, error) {
+	metaIndex := slices.IndexFunc(cf.History, func(h v1.History) bool {
+		return h.CreatedBy == utils.CreatedByCracMeta
+	})
+	if metaIndex < 0 {
+		return nil, fmt.Errorf("invalid, \"%s\" not found", utils.CreatedByCracMeta)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	if metaIndex >= len(layers) {
+		return nil, fmt.Errorf("invalid, \"%s\" has no layer", utils.CreatedByCracMeta)
+	}
+	metaReader, err := layers[metaIndex].Uncompressed()
+	if err != nil {
+		return nil, err
+	}
+	defer metaReader.Close()
+	data, err := tarhelper.UntarFile(metaReader, fmt.Sprintf("/%s/%s", utils.Crac, file))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
@@ -0,0 +1,48 @@
+package api
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/ssuf1998dev/container-registry-as-cache/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestList(t *testing.T) {
+	repo := newTestRegistry(t, false)
+	foo, _ := filepath.Abs("../testdata/foo")
+	common := []Option{
+		WithContext(t.Context()),
+		WithRepository(repo),
+		WithForceHttp(true),
+		WithDepFiles(map[string]string{"../testdata/foo": foo}),
+		WithFiles(map[string]string{"foo": foo}),
+		WithPlatform("linux/amd64"),
+	}
+
+	for _, key := range []string{"a", "b"} {
+		_, err := PushWithResult(append(common, WithKeys([]string{key}), WithTagPrefix("scope"))...)
+		require.NoError(t, err)
+	}
+	_, err := PushWithResult(append(common, WithKeys([]string{"c"}))...)
+	require.NoError(t, err)
+
+	entries, err := List(WithContext(t.Context()), WithRepository(repo), WithForceHttp(true))
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	keys := []string{}
+	for _, e := range entries {
+		keys = append(keys, e.Keys...)
+		assert.Equal(t, "linux/amd64", e.Platform)
+		assert.Equal(t, utils.CracVersion.String(), e.Version)
+		assert.Greater(t, e.Size, int64(0))
+		assert.NotEmpty(t, e.Digest)
+		assert.False(t, e.Created.IsZero())
+	}
+	assert.ElementsMatch(t, []string{"a", "b", "c"}, keys)
+
+	entries, err = List(WithContext(t.Context()), WithRepository(repo), WithForceHttp(true), WithTagPrefix("scope"))
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/dustin/go-humanize"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// dedupe looks up layers of img in the repository and the repositories of WithMountFrom,
+// layers found in the repository are not uploaded, and layers found in another repository are
+// mounted from it. It returns img with mountable layers, and the compressed size not uploaded,
+// assuming the registry supports mounting.
+func (b *registryBackend) dedupe(ctx context.Context, img v1.Image) (v1.Image, int64, error) {
+	repo, err := b.o.repository()
+	if err != nil {
+		return nil, 0, err
+	}
+	sources := []name.Repository{}
+	for _, from := range b.o.mountFrom {
+		_, from = parseRepository(from)
+		source, err := name.NewRepository(from, b.o.nameOptions()...)
+		if err != nil {
+			return nil, 0, err
+		}
+		if source.RegistryStr() != repo.RegistryStr() {
+			return nil, 0, fmt.Errorf("mount source \"%s\" is not on registry \"%s\"", from, repo.RegistryStr())
+		}
+		sources = append(sources, source)
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, 0, err
+	}
+	mounts := map[v1.Hash]name.Digest{}
+	seen := map[v1.Hash]bool{}
+	var saved int64
+	for _, layer := range layers {
+		digest, err := layer.Digest()
+		if err != nil {
+			return nil, 0, err
+		}
+		size, err := layer.Size()
+		if err != nil {
+			return nil, 0, err
+		}
+		if seen[digest] {
+			continue
+		}
+		seen[digest] = true
+		if ok, err := b.blobExists(ctx, repo.Digest(digest.String())); err != nil {
+			slog.Warn("layer lookup failed", "digest", digest, "err", err)
+		} else if ok {
+			slog.Info("layer exists, skip uploading", "digest", digest, "size", humanize.Bytes(uint64(size)))
+			saved += size
+			continue
+		}
+		for _, source := range sources {
+			ref := source.Digest(digest.String())
+			ok, err := b.blobExists(ctx, ref)
+			if err != nil {
+				slog.Warn("mount source unavailable", "repo", source.String(), "err", err)
+				continue
+			}
+			if ok {
+				slog.Info("layer mounting", "digest", digest, "from", source.String(), "size", humanize.Bytes(uint64(size)))
+				mounts[digest] = ref
+				saved += size
+				break
+			}
+		}
+	}
+	if len(mounts) == 0 {
+		return img, saved, nil
+	}
+	return &mountableImage{Image: img, mounts: mounts}, saved, nil
+}
+
+func (b *registryBackend) blobExists(ctx context.Context, ref name.Digest) (bool, error) {
+	layer, err := remote.Layer(ref, b.o.remoteOptions(remote.WithContext(ctx))...)
+	if err != nil {
+		return false, err
+	}
+	ok, err := partial.Exists(layer)
+	if isNotFound(err) {
+		return false, nil
+	}
+	return ok, err
+}
+
+// mountableImage makes remote.Write mount layers from other repositories rather than uploading,
+// registries not supporting mounting fall back to uploading.
+type mountableImage struct {
+	v1.Image
+	mounts map[v1.Hash]name.Digest
+}
+
+func (i *mountableImage) mountable(l v1.Layer) v1.Layer {
+	digest, err := l.Digest()
+	if err != nil {
+		return l
+	}
+	if ref, ok := i.mounts[digest]; ok {
+		return &remote.MountableLayer{Layer: l, Reference: ref}
+	}
+	return l
+}
+
+func (i *mountableImage) Layers() ([]v1.Layer, error) {
+	layers, err := i.Image.Layers()
+	if err != nil {
+		return nil, err
+	}
+	wrapped := make([]v1.Layer, len(layers))
+	for idx, l := range layers {
+		wrapped[idx] = i.mountable(l)
+	}
+	return wrapped, nil
+}
+
+func (i *mountableImage) LayerByDigest(h v1.Hash) (v1.Layer, error) {
+	l, err := i.Image.LayerByDigest(h)
+	if err != nil {
+		return nil, err
+	}
+	return i.mountable(l), nil
+}
@@ -6,19 +6,27 @@ import (
 	"maps"
 	"os"
 	"path/filepath"
+	"time"
 
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/ssuf1998dev/container-registry-as-cache/internal/blobcache"
 	cracprofile "github.com/ssuf1998dev/container-registry-as-cache/internal/profile"
+	"github.com/ssuf1998dev/container-registry-as-cache/internal/tarhelper"
+	"github.com/ssuf1998dev/container-registry-as-cache/internal/utils"
 )
 
 type Option func(*options)
 
 type options struct {
-	context   context.Context
-	repo      string
-	username  string
-	password  string
-	forceHttp bool
-	insecure  bool
+	context     context.Context
+	repo        string
+	backend     Backend
+	backendType string
+	username    string
+	password    string
+	keychain    authn.Keychain
+	forceHttp   bool
+	insecure    bool
 
 	keys     []string
 	depFiles map[string]string
@@ -26,14 +34,58 @@ type options struct {
 	platform string
 	filePerm fs.FileMode
 
-	tag     string
-	workdir string
+	noSymlinks  bool
+	noHardlinks bool
+	noDirs      bool
+	noModes     bool
+	noMtimes    bool
+	maxEntries  int
+	maxSize     int64
+	atomic      bool
+
+	reproducible bool
+	split        utils.Split
+
+	tag         string
+	tagPrefix   string
+	tagLength   int
+	hashScheme  string
+	restoreKeys []string
+	workdir     string
+	// hash is computed once by Run rather than from dep files, which the command may change
+	hash string
+
+	blobCacheDir  string
+	blobCacheSize int64
+
+	maxAge       time.Duration
+	keepLatest   int
+	maxTotalSize int64
+	dryRun       bool
+	listFiles    bool
 
 	outputStdout bool
 	outputBytes  bool
 	outputFile   string
 
-	forcePush bool
+	forcePush     bool
+	skipUnchanged bool
+	mountFrom     []string
+	base          string
+	maxDepth      int
+}
+
+func newOptions(opts ...Option) *options {
+	o := &options{
+		context:  context.Background(),
+		keys:     []string{},
+		depFiles: map[string]string{},
+		files:    map[string]string{},
+	}
+	for _, option := range opts {
+		option(o)
+	}
+	return o
 }
 
 func WithContext(ctx context.Context) Option {
@@ -48,6 +100,22 @@ func WithRepository(repository string) Option {
 	}
 }
 
+// WithBackend stores cache images in backend instead of the one picked by the repository.
+func WithBackend(backend Backend) Option {
+	return func(o *options) {
+		o.backend = backend
+	}
+}
+
+// WithBackendType picks a built-in backend, could be "registry", "dir" or "oci", the repository
+// is the location for all of them. A scheme of the repository, "docker://", "dir:" or "oci:",
+// picks it as well.
+func WithBackendType(backendType string) Option {
+	return func(o *options) {
+		o.backendType = backendType
+	}
+}
+
 func WithUsername(username string) Option {
 	return func(o *options) {
 		o.username = username
@@ -60,6 +128,14 @@ func WithPassword(password string) Option {
 	}
 }
 
+// WithKeychain overrides the keychain resolving credentials when username or password is not set,
+// defaults to authn.DefaultKeychain which reads docker config and runs credential helpers.
+func WithKeychain(keychain authn.Keychain) Option {
+	return func(o *options) {
+		o.keychain = keychain
+	}
+}
+
 func WithForceHttp(forceHttp bool) Option {
 	return func(o *options) {
 		o.forceHttp = forceHttp
@@ -90,6 +166,17 @@ func WithFiles(files map[string]string) Option {
 	}
 }
 
+// WithFilePatterns scans files, directories and symlinks matching patterns, glob supported.
+// Put it after WithNoSymlinks since symlinks are followed with that.
+func WithFilePatterns(patterns []string) Option {
+	return func(o *options) {
+		if o.files == nil {
+			o.files = map[string]string{}
+		}
+		maps.Copy(o.files, utils.ScanEntries(patterns, o.noSymlinks))
+	}
+}
+
 func WithPlatform(platform string) Option {
 	return func(o *options) {
 		o.platform = platform
@@ -102,12 +189,158 @@ func WithFilePerm(perm fs.FileMode) Option {
 	}
 }
 
+func WithNoSymlinks(enable bool) Option {
+	return func(o *options) {
+		o.noSymlinks = enable
+	}
+}
+
+func WithNoHardlinks(enable bool) Option {
+	return func(o *options) {
+		o.noHardlinks = enable
+	}
+}
+
+func WithNoDirs(enable bool) Option {
+	return func(o *options) {
+		o.noDirs = enable
+	}
+}
+
+func WithNoModes(enable bool) Option {
+	return func(o *options) {
+		o.noModes = enable
+	}
+}
+
+func WithNoMtimes(enable bool) Option {
+	return func(o *options) {
+		o.noMtimes = enable
+	}
+}
+
+// WithReproducible makes the cache layer only depend on names, modes and contents of files,
+// mtimes are set to SOURCE_DATE_EPOCH, or the Unix epoch if it is not set. The created time
+// of the image is SOURCE_DATE_EPOCH as well if it is set.
+func WithReproducible(enable bool) Option {
+	return func(o *options) {
+		o.reproducible = enable
+	}
+}
+
+// WithLayerSplit partitions the cache into layers by utils.SplitDir or utils.SplitHash, layers
+// of unchanged groups keep their digests across pushes, utils.SplitNone by default.
+func WithLayerSplit(mode string) Option {
+	return func(o *options) {
+		o.split.Mode = mode
+	}
+}
+
+// WithLayerDepth sets how many leading path components make the group of a file, 1 by default.
+func WithLayerDepth(depth int) Option {
+	return func(o *options) {
+		o.split.Depth = depth
+	}
+}
+
+// WithLayerCount sets the number of buckets of utils.SplitHash, empty buckets are dropped.
+func WithLayerCount(count int) Option {
+	return func(o *options) {
+		o.split.Layers = count
+	}
+}
+
+// WithMaxEntries caps the entry count when extracting, negative means no limit.
+func WithMaxEntries(maxEntries int) Option {
+	return func(o *options) {
+		o.maxEntries = maxEntries
+	}
+}
+
+// WithMaxSize caps the total size of extracted files, negative means no limit.
+func WithMaxSize(maxSize int64) Option {
+	return func(o *options) {
+		o.maxSize = maxSize
+	}
+}
+
+// WithAtomic makes pulling extract into a staging directory first, then entries of the cache
+// replace existing ones in workdir by renaming, existing directories are merged into like
+// without it, workdir is untouched if pulling fails.
+func WithAtomic(atomic bool) Option {
+	return func(o *options) {
+		o.atomic = atomic
+	}
+}
+
+func (o *options) tarOptions() tarhelper.Options {
+	return tarhelper.Options{
+		NoSymlinks:  o.noSymlinks,
+		NoHardlinks: o.noHardlinks,
+		NoDirs:      o.noDirs,
+		NoModes:     o.noModes,
+		NoMtimes:    o.noMtimes,
+		FilePerm:    o.filePerm,
+		MaxEntries:  o.maxEntries,
+		MaxSize:     o.maxSize,
+		Mtime:       o.mtime(),
+	}
+}
+
+// mtime returns the mtime of all archived entries, zero keeps mtimes of files.
+func (o *options) mtime() time.Time {
+	if !o.reproducible {
+		return time.Time{}
+	}
+	if t, ok := utils.SourceDateEpoch(); ok {
+		return t
+	}
+	return time.Unix(0, 0).UTC()
+}
+
 func WithTag(tag string) Option {
 	return func(o *options) {
 		o.tag = tag
 	}
 }
 
+// withHash uses hash rather than computing it from dep files and keys.
+func withHash(hash string) Option {
+	return func(o *options) {
+		o.hash = hash
+	}
+}
+
+func WithTagPrefix(prefix string) Option {
+	return func(o *options) {
+		o.tagPrefix = prefix
+	}
+}
+
+// WithTagLength sets how many hex characters of the hash are kept in tags, from 4 to 64,
+// utils.DefaultTagLength if zero. Longer tags are less likely to collide.
+func WithTagLength(length int) Option {
+	return func(o *options) {
+		o.tagLength = length
+	}
+}
+
+// WithHashScheme picks how dep files and keys are hashed into tags, utils.DefaultHashScheme
+// if empty. Cache images of another scheme never match.
+func WithHashScheme(scheme string) Option {
+	return func(o *options) {
+		o.hashScheme = scheme
+	}
+}
+
+// WithRestoreKeys sets tag prefixes to try in order when the exact tag is missing,
+// the newest cache image of the first matched prefix is pulled.
+func WithRestoreKeys(restoreKeys []string) Option {
+	return func(o *options) {
+		o.restoreKeys = restoreKeys
+	}
+}
+
 func WithWorkdir(workdir string) Option {
 	return func(o *options) {
 		if len(workdir) != 0 {
@@ -154,7 +387,66 @@ func WithProfile(profile string, profileType string) Option {
 		if o.files == nil {
 			o.files = map[string]string{}
 		}
-		maps.Copy(o.files, p.Files.Value)
+		// directories and symlinks are cache content as well
+		maps.Copy(o.files, utils.ScanEntries(p.Files.Patterns, o.noSymlinks))
+	}
+}
+
+// WithBlobCache keeps layers pulled from or pushed to a registry in dir, pulling reads a layer
+// from it if the digest is there. Blobs are evicted by LRU when the total size exceeds maxSize,
+// 0 means the default size and negative means no limit. Empty dir disables it, the default.
+func WithBlobCache(dir string, maxSize int64) Option {
+	return func(o *options) {
+		o.blobCacheDir = dir
+		o.blobCacheSize = maxSize
+	}
+}
+
+// blobCache returns the blob cache if it is enabled, only registries are cached since
+// other backends are on disk already.
+func (o *options) blobCache(backend Backend) *blobcache.Cache {
+	if len(o.blobCacheDir) == 0 {
+		return nil
+	}
+	if _, ok := backend.(*registryBackend); !ok {
+		return nil
+	}
+	return blobcache.New(o.blobCacheDir, o.blobCacheSize)
+}
+
+// WithMaxAge makes pruning delete cache images created earlier than maxAge ago.
+func WithMaxAge(maxAge time.Duration) Option {
+	return func(o *options) {
+		o.maxAge = maxAge
+	}
+}
+
+// WithKeepLatest makes pruning keep the newest n cache images of each key scope, aka tag prefix.
+func WithKeepLatest(n int) Option {
+	return func(o *options) {
+		o.keepLatest = n
+	}
+}
+
+// WithMaxTotalSize makes pruning delete the oldest cache images until the total size is under maxSize.
+func WithMaxTotalSize(maxSize int64) Option {
+	return func(o *options) {
+		o.maxTotalSize = maxSize
+	}
+}
+
+// WithDryRun makes pruning report what would be deleted without deleting.
+func WithDryRun(dryRun bool) Option {
+	return func(o *options) {
+		o.dryRun = dryRun
+	}
+}
+
+// WithListFiles makes inspecting list files in the cache layer, the layer is streamed
+// but not extracted.
+func WithListFiles(enable bool) Option {
+	return func(o *options) {
+		o.listFiles = enable
 	}
 }
 
@@ -181,3 +473,37 @@ func WithForcePush(forcePush bool) Option {
 		o.forcePush = forcePush
 	}
 }
+
+// WithMountFrom sets repositories on the same registry to mount layers from when pushing to
+// a registry, layers found in them are linked rather than uploaded.
+func WithMountFrom(repos []string) Option {
+	return func(o *options) {
+		o.mountFrom = repos
+	}
+}
+
+// WithSkipUnchanged makes pushing build the cache layer first, then skip if the cache image
+// under the tag has the same layer digest, it takes precedence over WithForcePush.
+// Layers are only the same across machines or runs with WithReproducible.
+func WithSkipUnchanged(enable bool) Option {
+	return func(o *options) {
+		o.skipUnchanged = enable
+	}
+}
+
+// WithBase makes pushing stack a delta layer of added, changed and deleted files on the cache
+// image tagged base, or the newest one whose tag starts with base, a full cache image is pushed
+// if none is found.
+func WithBase(base string) Option {
+	return func(o *options) {
+		o.base = base
+	}
+}
+
+// WithMaxDepth caps delta layers of WithBase, pushing compacts into full layers beyond it,
+// utils.DefaultMaxDepth if zero.
+func WithMaxDepth(depth int) Option {
+	return func(o *options) {
+		o.maxDepth = depth
+	}
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/ssuf1998dev/container-registry-as-cache/internal/utils"
+)
+
+type PruneResult struct {
+	Deleted []*Entry `json:"deleted"`
+	Kept    []*Entry `json:"kept"`
+	// ReclaimedSize is the size of layers only referenced by deleted cache images,
+	// registries may need garbage collecting to free it.
+	ReclaimedSize int64 `json:"reclaimedSize"`
+	DryRun        bool  `json:"dryRun"`
+}
+
+// Prune deletes cache images by retention policies set with WithMaxAge, WithKeepLatest and
+// WithMaxTotalSize, an image is deleted if any policy says so. Only tags starting with the tag
+// prefix are considered if it is set.
+func Prune(opts ...Option) (*PruneResult, error) {
+	o := newOptions(opts...)
+	if o.maxAge <= 0 && o.keepLatest <= 0 && o.maxTotalSize <= 0 {
+		return nil, fmt.Errorf("no retention policy is set")
+	}
+	backend, err := o.storage()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := o.list(backend)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &PruneResult{Deleted: []*Entry{}, Kept: []*Entry{}, DryRun: o.dryRun}
+	scopes := map[string]int{}
+	var total int64
+	now := time.Now()
+	// entries are newest first
+	for _, e := range entries {
+		scope, _ := utils.SplitTag(e.Tag)
+		scopes[scope]++
+
+		reason := ""
+		switch {
+		case o.maxAge > 0 && now.Sub(e.Created) > o.maxAge:
+			reason = "age"
+		case o.keepLatest > 0 && scopes[scope] > o.keepLatest:
+			reason = "count"
+		case o.maxTotalSize > 0 && total+e.Size > o.maxTotalSize:
+			reason = "size"
+		}
+		if len(reason) == 0 {
+			total += e.Size
+			result.Kept = append(result.Kept, e)
+			continue
+		}
+		slog.Info("cache image to delete", "tag", e.Tag, "reason", reason, "created", e.Created.String(), "size", humanize.Bytes(uint64(e.Size)))
+		result.Deleted = append(result.Deleted, e)
+	}
+
+	// registries delete by manifest digest, which drops every tag on the manifest, so a cache image
+	// sharing its manifest with a kept one, like a reproducible push under another tag, is kept
+	_, byDigest := backend.(*registryBackend)
+	if byDigest {
+		keptDigests := map[string]bool{}
+		for _, e := range result.Kept {
+			keptDigests[e.Digest] = true
+		}
+		deleted := []*Entry{}
+		for _, e := range result.Deleted {
+			if len(e.Digest) != 0 && keptDigests[e.Digest] {
+				slog.Info("cache image shares its manifest with a kept one, keep", "tag", e.Tag, "digest", e.Digest)
+				result.Kept = append(result.Kept, e)
+				continue
+			}
+			deleted = append(deleted, e)
+		}
+		result.Deleted = deleted
+	}
+
+	kept := map[string]bool{}
+	for _, e := range result.Kept {
+		for digest := range e.layers {
+			kept[digest] = true
+		}
+	}
+	reclaimed := map[string]int64{}
+	for _, e := range result.Deleted {
+		for digest, size := range e.layers {
+			if !kept[digest] {
+				reclaimed[digest] = size
+			}
+		}
+	}
+	for _, size := range reclaimed {
+		result.ReclaimedSize += size
+	}
+
+	if o.dryRun {
+		return result, nil
+	}
+	errs := []error{}
+	deletedDigests := map[string]bool{}
+	for _, e := range result.Deleted {
+		err := backend.Delete(o.context, e.Tag)
+		// registries may have deleted the tag with an earlier one on the same manifest
+		if byDigest && errors.Is(err, ErrNotFound) && deletedDigests[e.Digest] {
+			err = nil
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("tag \"%s\" is not deleted, %w", e.Tag, err))
+			continue
+		}
+		deletedDigests[e.Digest] = true
+	}
+	return result, errors.Join(errs...)
+}
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrune(t *testing.T) {
+	repo := newTestRegistry(t, false)
+	foo, _ := filepath.Abs("../testdata/foo")
+	common := []Option{
+		WithContext(t.Context()),
+		WithRepository(repo),
+		WithForceHttp(true),
+	}
+	for _, c := range []struct{ prefix, key string }{{"a", "1"}, {"a", "2"}, {"b", "3"}} {
+		_, err := PushWithResult(append(common,
+			WithDepFiles(map[string]string{"../testdata/foo": foo}),
+			WithFiles(map[string]string{"foo": foo}),
+			WithTagPrefix(c.prefix),
+			WithKeys([]string{c.key}),
+		)...)
+		require.NoError(t, err)
+	}
+
+	_, err := Prune(common...)
+	require.Error(t, err)
+
+	result, err := Prune(append(common, WithKeepLatest(1), WithDryRun(true))...)
+	require.NoError(t, err)
+	assert.Len(t, result.Deleted, 1)
+	assert.Len(t, result.Kept, 2)
+	// the cache layer is shared with kept images, only the meta layer is reclaimed
+	assert.Greater(t, result.ReclaimedSize, int64(0))
+	assert.Less(t, result.ReclaimedSize, result.Deleted[0].Size)
+	entries, err := List(common...)
+	require.NoError(t, err)
+	assert.Len(t, entries, 3)
+
+	result, err = Prune(append(common, WithKeepLatest(1))...)
+	require.NoError(t, err)
+	assert.Len(t, result.Deleted, 1)
+	entries, err = List(common...)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+
+	result, err = Prune(append(common, WithMaxAge(time.Nanosecond), WithTagPrefix("b"))...)
+	require.NoError(t, err)
+	assert.Len(t, result.Deleted, 1)
+	entries, err = List(common...)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "a", entries[0].Tag[:1])
+}
+
+func TestPrune_SharedDigest(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+	repo := newTestRegistry(t, false)
+	foo, _ := filepath.Abs("../testdata/foo")
+	common := []Option{
+		WithContext(t.Context()),
+		WithRepository(repo),
+		WithForceHttp(true),
+	}
+	digests := map[string]bool{}
+	for _, tag := range []string{"a-1", "a-2"} {
+		result, err := PushWithResult(append(common,
+			WithFiles(map[string]string{"foo": foo}),
+			WithTag(tag),
+			WithReproducible(true),
+		)...)
+		require.NoError(t, err)
+		digests[result.Digest] = true
+	}
+	require.Len(t, digests, 1)
+
+	// deleting one by digest would delete the kept one too
+	result, err := Prune(append(common, WithKeepLatest(1))...)
+	require.NoError(t, err)
+	assert.Empty(t, result.Deleted)
+	assert.Len(t, result.Kept, 2)
+	entries, err := List(common...)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+
+	result, err = Prune(append(common, WithMaxAge(time.Nanosecond))...)
+	require.NoError(t, err)
+	assert.Len(t, result.Deleted, 2)
+	entries, err = List(common...)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
@@ -1,140 +1,337 @@
 package api
 
 import (
-	"context"
-	"crypto/tls"
+	"archive/tar"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
-	"net/http"
+	"maps"
 	"os"
+	"path"
 	"slices"
 	"strings"
 	"time"
 
 	"github.com/Masterminds/semver/v3"
 	"github.com/dustin/go-humanize"
-	"github.com/goccy/go-yaml"
-	"github.com/google/go-containerregistry/pkg/authn"
-	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
-	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/ssuf1998dev/container-registry-as-cache/internal/tarhelper"
 	"github.com/ssuf1998dev/container-registry-as-cache/internal/utils"
 )
 
 func Pull(opts ...Option) error {
-	o := &options{
-		context:  context.Background(),
-		keys:     []string{},
-		depFiles: map[string]string{},
-		files:    map[string]string{},
-	}
-	for _, option := range opts {
-		option(o)
-	}
-
-	_, err := pull(o)
+	_, err := PullWithResult(opts...)
 	return err
 }
 
-func pull(opts *options) (tars []byte, err error) {
-	tag := opts.tag
-	var keys []string
-	if len(tag) == 0 {
-		keys = append(keys, opts.keys...)
-		if len(opts.platform) > 0 {
-			keys = append(keys, opts.platform)
-		}
-		tag, err = utils.ComputeTag(opts.depFiles, keys, opts.workdir)
-		if err != nil {
-			return nil, err
-		}
-	}
-	repo := opts.repo
-	if len(repo) == 0 {
-		repo = fmt.Sprintf("%s/%s", name.DefaultRegistry, utils.Crac)
-	}
-	nameOpts := []name.Option{}
-	if opts.forceHttp {
-		nameOpts = append(nameOpts, name.Insecure)
-	}
-	ref, err := name.ParseReference(fmt.Sprintf("%s:%s", repo, tag), nameOpts...)
+// PullWithResult is like Pull but tells what is pulled, the result is also returned with
+// a miss, the error of which matches ErrCacheMiss.
+func PullWithResult(opts ...Option) (*Result, error) {
+	result, _, err := pull(newOptions(opts...))
+	return result, err
+}
+
+func pull(opts *options) (result *Result, tars []byte, err error) {
+	start := time.Now()
+	result = &Result{}
+	defer func() {
+		result.Timing.Total = time.Since(start)
+	}()
+
+	tag, keys, err := opts.computeTag()
 	if err != nil {
-		return nil, err
+		return result, nil, err
 	}
-	slog.Info("reference", "repo", repo, "tag", tag, "keys", strings.Join(keys, ", "), "depFiles", len(opts.depFiles))
-
-	transport := remote.DefaultTransport.(*http.Transport)
-	if opts.insecure {
-		transport = transport.Clone()
-		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	backend, err := opts.storage()
+	if err != nil {
+		return result, nil, err
 	}
+	result.Tag, result.Reference = tag, backend.Reference(tag)
+	slog.Info("reference", "repo", opts.repoName(), "tag", tag, "keys", strings.Join(keys, ", "), "depFiles", len(opts.depFiles))
 
-	remoteOpts := []remote.Option{
-		remote.WithContext(opts.context),
-		remote.WithTransport(transport),
+	tag, exact, img, err := opts.resolve(backend, tag)
+	if err != nil {
+		if errors.Is(err, ErrCacheMiss) {
+			result.Status = StatusMiss
+		}
+		return result, nil, err
 	}
-	if len(opts.username) != 0 && len(opts.password) != 0 {
-		remoteOpts = append(remoteOpts, remote.WithAuth(&authn.Basic{Username: opts.username, Password: opts.password}))
+	slog.Info("cache hit", "tag", tag, "exact", exact)
+	result.Tag, result.Reference = tag, backend.Reference(tag)
+	if digest, err := img.Digest(); err == nil {
+		result.Digest = digest.String()
 	}
-	img, err := remote.Image(ref, remoteOpts...)
+
+	entry, err := describe(backend, tag, img)
 	if err != nil {
-		return nil, err
+		return result, nil, err
 	}
-	cf, _ := img.ConfigFile()
-	imgSize, _ := utils.CompressedImageSize(img)
 	slog.Info(
 		"image found",
-		"created", cf.Created.Time.String(),
-		"age", time.Since(cf.Created.Time).Abs().String(),
-		"bsize", imgSize,
-		"size", humanize.Bytes(uint64(imgSize)),
+		"created", entry.Created.String(),
+		"age", entry.Age().String(),
+		"bsize", entry.Size,
+		"size", humanize.Bytes(uint64(entry.Size)),
 	)
-	metaIndex := slices.IndexFunc(cf.History, func(h v1.History) bool {
-		return h.CreatedBy == utils.CreatedByCracMeta
-	})
-	if metaIndex < 0 {
-		return nil, fmt.Errorf("invalid, \"%s\" not found", utils.CreatedByCracMeta)
-	}
-
-	layers, _ := img.Layers()
-	metaLayer := layers[metaIndex]
-	metaReader, _ := metaLayer.Uncompressed()
-	metaData, _ := tarhelper.UntarFile(metaReader, fmt.Sprintf("/%s/meta.yaml", utils.Crac))
-	var meta utils.CracMeta
-	_ = yaml.Unmarshal(metaData, &meta)
-	if len(meta.Version) == 0 || !utils.CracVersionConstraint.Check(semver.MustParse(meta.Version)) {
-		return nil, fmt.Errorf("invalid, version does't meet the constraint, (%s)", utils.CracVersionConstraint.String())
-	}
-
-	cacheIndex := slices.IndexFunc(cf.History, func(h v1.History) bool {
-		return h.CreatedBy == utils.CreatedByCracCopy
-	})
-	if cacheIndex < 0 {
-		return nil, fmt.Errorf("invalid, \"%s\" not found", utils.CreatedByCracCopy)
+	if len(entry.Version) == 0 || !utils.CracVersionConstraint.Check(semver.MustParse(entry.Version)) {
+		return result, nil, fmt.Errorf("invalid, version does't meet the constraint, (%s)", utils.CracVersionConstraint.String())
+	}
+	if exact {
+		if err := opts.verifyHash(entry.meta); err != nil {
+			if errors.Is(err, ErrCacheMiss) {
+				result.Status = StatusMiss
+			}
+			return result, nil, err
+		}
+	}
+
+	cf, _ := img.ConfigFile()
+	layers, err := cacheLayers(img)
+	if err != nil {
+		return result, nil, err
+	}
+	bc := opts.blobCache(backend)
+	for i, layer := range layers {
+		if bc != nil {
+			digest, _ := layer.Digest()
+			slog.Info("blob cache", "dir", bc.Dir(), "digest", digest, "hit", bc.Has(digest))
+			layers[i], _ = bc.Layer(layer)
+		}
+		size, _ := layers[i].Size()
+		result.CompressedSize += size
+	}
+	result.Timing.Resolve = time.Since(start)
+	cacheReader := flattenLayers(layers, entry.meta.Depth)
+	defer cacheReader.Close()
+	counter := &countReader{r: cacheReader}
+	status := StatusHit
+	if !exact {
+		status = StatusPartial
 	}
 
-	cacheLayer := layers[cacheIndex]
-	cacheReader, _ := cacheLayer.Uncompressed()
 	if opts.outputStdout {
-		_, err := io.Copy(os.Stdout, cacheReader)
-		return nil, err
+		_, err := io.Copy(os.Stdout, counter)
+		result.UncompressedSize = counter.n
+		result.Timing.Transfer = time.Since(start) - result.Timing.Resolve
+		if err != nil {
+			return result, nil, err
+		}
+		result.Status = status
+		return result, nil, nil
 	}
 
 	if opts.outputBytes {
-		return io.ReadAll(cacheReader)
+		b, err := io.ReadAll(counter)
+		result.UncompressedSize = counter.n
+		result.Timing.Transfer = time.Since(start) - result.Timing.Resolve
+		if err != nil {
+			return result, nil, err
+		}
+		result.Status = status
+		return result, b, nil
 	}
 
 	slog.Info(
-		"uncompressing cache layer from image...",
+		"uncompressing cache layers from image...",
+		"layers", len(layers),
 		"workdir", opts.workdir,
 		"perm", opts.filePerm.String(),
+		"atomic", opts.atomic,
 	)
-	err = tarhelper.Untar(cacheReader, opts.workdir, opts.filePerm)
+	checksums, err := readChecksums(img, cf, entry.meta)
+	if err != nil {
+		return result, nil, err
+	}
+	tarOptions := opts.tarOptions()
+	tarOptions.Checksums = checksums != nil
+	var stats tarhelper.Stats
+	if opts.atomic {
+		stats, err = tarhelper.UntarAtomic(counter, opts.workdir, tarOptions, func(stats tarhelper.Stats) error {
+			// reading to the end makes the layer verified against its digest
+			if _, err := io.Copy(io.Discard, counter); err != nil {
+				return err
+			}
+			if err := cacheReader.Close(); err != nil {
+				return err
+			}
+			return verifyExtracted(entry.meta, checksums, stats)
+		})
+	} else {
+		stats, err = tarhelper.Untar(counter, opts.workdir, tarOptions)
+		if err == nil {
+			// the rest is tar padding, reading it verifies the layer and completes the blob cache
+			if _, err = io.Copy(io.Discard, counter); err == nil {
+				err = cacheReader.Close()
+			}
+		}
+		if err == nil {
+			err = verifyExtracted(entry.meta, checksums, stats)
+		}
+	}
+	result.UncompressedSize = counter.n
+	result.Files = stats.Files
+	result.Timing.Transfer = time.Since(start) - result.Timing.Resolve
+	if err != nil {
+		return result, nil, err
+	}
+	slog.Info("uncompressed", "files", stats.Files, "size", humanize.Bytes(uint64(stats.Size)))
+	result.Status = status
+	return result, nil, nil
+}
+
+// verifyExtracted compares what is extracted with the meta, cache images pushed by older
+// versions have neither the counts nor the checksums, so nothing is compared.
+func verifyExtracted(meta *utils.CracMeta, checksums map[string]string, stats tarhelper.Stats) error {
+	if meta.Files != 0 && (meta.Files != stats.Files || meta.Size != stats.Size) {
+		return fmt.Errorf("invalid, %d files of %d bytes extracted, %d files of %d bytes expected", stats.Files, stats.Size, meta.Files, meta.Size)
+	}
+	for name, sum := range checksums {
+		if stats.Checksums[name] != sum {
+			return fmt.Errorf("invalid, checksum of \"%s\" mismatches", name)
+		}
+	}
+	return nil
+}
+
+// cacheLayers returns the cache layers found by CRACCOPY history entries, in order.
+func cacheLayers(img v1.Image) ([]v1.Layer, error) {
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	layers, err := img.Layers()
 	if err != nil {
 		return nil, err
 	}
-	slog.Info("uncompressed")
-	return nil, nil
+	found := []v1.Layer{}
+	for i, h := range cf.History {
+		if h.CreatedBy == utils.CreatedByCracCopy && i < len(layers) {
+			found = append(found, layers[i])
+		}
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("invalid, \"%s\" not found", utils.CreatedByCracCopy)
+	}
+	return found, nil
+}
+
+// flattenLayers streams entries of all layers as one tar, applying upper layers on top of
+// lower ones like an image filesystem. Layers are read from the top, an entry already written by
+// an upper layer, or deleted by a whiteout of an upper layer is skipped, whiteouts themselves are
+// never written. Only the top deltas layers are delta layers pushed with a base, entries of other
+// layers are never whiteouts, even named like them. Each layer is read to the end and closed
+// before the next one, which verifies it against its digest, and fails the stream if it mismatches.
+func flattenLayers(layers []v1.Layer, deltas int) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		f := &flattener{tw: tw, written: map[string]bool{}, deleted: map[string]bool{}}
+		for i, layer := range slices.Backward(layers) {
+			if err := f.copyLayer(layer, i >= len(layers)-deltas); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.CloseWithError(tw.Close())
+	}()
+	return pr
+}
+
+type flattener struct {
+	tw      *tar.Writer
+	written map[string]bool
+	// deleted are names whited out by upper layers, together with entries inside them
+	deleted map[string]bool
+}
+
+func (f *flattener) copyLayer(layer v1.Layer, delta bool) error {
+	rc, err := layer.Uncompressed()
+	if err != nil {
+		return err
+	}
+	if err := f.copyTar(rc, delta); err != nil {
+		rc.Close()
+		return err
+	}
+	return rc.Close()
+}
+
+func (f *flattener) copyTar(r io.Reader, delta bool) error {
+	// whiteouts only apply to lower layers
+	deleted := map[string]bool{}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean(header.Name)
+		if target, ok := tarhelper.IsWhiteout(name); ok && delta {
+			deleted[target] = true
+			continue
+		}
+		if f.written[name] || f.isDeleted(name) {
+			continue
+		}
+		f.written[name] = true
+		if err := f.tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := io.Copy(f.tw, tr); err != nil {
+			return err
+		}
+	}
+	maps.Copy(f.deleted, deleted)
+	// the rest is tar padding
+	_, err := io.Copy(io.Discard, r)
+	return err
+}
+
+func (f *flattener) isDeleted(name string) bool {
+	for ; name != "." && name != "/"; name = path.Dir(name) {
+		if f.deleted[name] {
+			return true
+		}
+	}
+	return false
+}
+
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// resolve gets the image of tag, or the newest one matching restore keys if tag does not exist,
+// the error matches ErrCacheMiss if neither exists.
+func (o *options) resolve(backend Backend, tag string) (resolved string, exact bool, img v1.Image, err error) {
+	img, err = backend.Get(o.context, tag)
+	if err == nil {
+		return tag, true, img, nil
+	}
+	if !isNotFound(err) {
+		return tag, false, nil, err
+	}
+	if len(o.restoreKeys) == 0 {
+		return tag, false, nil, fmt.Errorf("%w, tag \"%s\" not found", ErrCacheMiss, tag)
+	}
+	slog.Info("cache image not found, trying restore keys...", "tag", tag, "restoreKeys", strings.Join(o.restoreKeys, ", "))
+	restoreTag, err := o.findRestoreTag(backend)
+	if err != nil {
+		return tag, false, nil, err
+	}
+	if len(restoreTag) == 0 {
+		return tag, false, nil, fmt.Errorf("%w, tag \"%s\" and restore keys not found", ErrCacheMiss, tag)
+	}
+	img, err = backend.Get(o.context, restoreTag)
+	return restoreTag, false, img, err
 }
@@ -4,8 +4,14 @@ import (
 	"bytes"
 	"fmt"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
 
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/ssuf1998dev/container-registry-as-cache/internal/tarhelper"
 	"github.com/ssuf1998dev/container-registry-as-cache/internal/utils"
 	"github.com/stretchr/testify/assert"
@@ -15,16 +21,13 @@ import (
 func TestPull(t *testing.T) {
 	os.Unsetenv("HTTP_PROXY")
 	os.Unsetenv("http_proxy")
-	reg := os.Getenv("CRAC_TEST_REGISTRY")
-	if reg == "" {
-		t.Skipf("registry is empty, skip")
-	}
+	repo := testRegistryRepo(t)
 
 	deps := map[string]string{"../testdata/foo": "../testdata/foo"}
 
-	_, err := push(&options{
+	_, _, err := push(&options{
 		context:   t.Context(),
-		repo:      fmt.Sprintf("%s/%s", reg, utils.Crac),
+		repo:      repo,
 		username:  "testuser",
 		password:  "testpassword",
 		forceHttp: true,
@@ -35,9 +38,9 @@ func TestPull(t *testing.T) {
 	})
 	require.NoError(t, err)
 
-	cache, err := pull(&options{
+	_, cache, err := pull(&options{
 		context:     t.Context(),
-		repo:        fmt.Sprintf("%s/%s", reg, utils.Crac),
+		repo:        repo,
 		username:    "testuser",
 		password:    "testpassword",
 		forceHttp:   true,
@@ -50,3 +53,198 @@ func TestPull(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, string(b), "bar")
 }
+
+func TestPull_RestoreKeys(t *testing.T) {
+	repo := newTestRegistry(t, false)
+
+	_, _, err := push(&options{
+		context:   t.Context(),
+		repo:      repo,
+		forceHttp: true,
+		tagPrefix: "foo",
+		depFiles:  map[string]string{"../testdata/foo": "../testdata/foo"},
+		files:     map[string]string{"../testdata/foo": "../testdata/foo"},
+		forcePush: true,
+	})
+	require.NoError(t, err)
+
+	_, _, err = pull(&options{
+		context:     t.Context(),
+		repo:        repo,
+		forceHttp:   true,
+		tagPrefix:   "foo",
+		keys:        []string{"changed"},
+		depFiles:    map[string]string{"../testdata/foo": "../testdata/foo"},
+		outputBytes: true,
+	})
+	require.Error(t, err)
+
+	_, cache, err := pull(&options{
+		context:     t.Context(),
+		repo:        repo,
+		forceHttp:   true,
+		tagPrefix:   "foo",
+		restoreKeys: []string{"bar-", "foo-"},
+		keys:        []string{"changed"},
+		depFiles:    map[string]string{"../testdata/foo": "../testdata/foo"},
+		outputBytes: true,
+	})
+	require.NoError(t, err)
+	b, err := tarhelper.UntarFile(bytes.NewReader(cache), "../testdata/foo")
+	require.NoError(t, err)
+	assert.Equal(t, "bar", string(b))
+}
+
+func TestPull_Checksums(t *testing.T) {
+	foo, _ := filepath.Abs("../testdata/foo")
+	common := []Option{
+		WithContext(t.Context()),
+		WithRepository("oci:" + filepath.Join(t.TempDir(), "cache")),
+		WithDepFiles(map[string]string{"../testdata/foo": foo}),
+	}
+	pushed, err := PushWithResult(append(common, WithFiles(map[string]string{"foo": foo}))...)
+	require.NoError(t, err)
+
+	// replace the checksum manifest of the meta layer with a wrong one
+	backend, err := newOptions(common...).storage()
+	require.NoError(t, err)
+	img, err := backend.Get(t.Context(), pushed.Tag)
+	require.NoError(t, err)
+	cf, _ := img.ConfigFile()
+	metaData, err := readMetaData(img, cf)
+	require.NoError(t, err)
+	metaLayer, err := crane.Layer(map[string][]byte{
+		fmt.Sprintf("/%s/meta.yaml", utils.Crac):               metaData,
+		fmt.Sprintf("/%s/%s", utils.Crac, utils.ChecksumsFile): []byte(strings.Repeat("0", 64) + "  foo\n"),
+	})
+	require.NoError(t, err)
+	layers, _ := img.Layers()
+	tampered, err := mutate.Append(empty.Image,
+		mutate.Addendum{Layer: layers[0], History: cf.History[0]},
+		mutate.Addendum{Layer: metaLayer, History: cf.History[1]},
+	)
+	require.NoError(t, err)
+	require.NoError(t, backend.Put(t.Context(), pushed.Tag, tampered))
+
+	for _, atomic := range []bool{true, false} {
+		workdir := t.TempDir()
+		_, err = PullWithResult(append(common, WithWorkdir(workdir), WithAtomic(atomic))...)
+		require.ErrorContains(t, err, "checksum of \"foo\" mismatches")
+		if atomic {
+			_, err = os.Stat(filepath.Join(workdir, "foo"))
+			assert.True(t, os.IsNotExist(err))
+		}
+	}
+
+	// a missing checksum manifest is not taken as one without checksums
+	metaLayer, err = crane.Layer(map[string][]byte{fmt.Sprintf("/%s/meta.yaml", utils.Crac): metaData})
+	require.NoError(t, err)
+	tampered, err = mutate.Append(empty.Image,
+		mutate.Addendum{Layer: layers[0], History: cf.History[0]},
+		mutate.Addendum{Layer: metaLayer, History: cf.History[1]},
+	)
+	require.NoError(t, err)
+	require.NoError(t, backend.Put(t.Context(), pushed.Tag, tampered))
+	_, err = PullWithResult(append(common, WithWorkdir(t.TempDir()))...)
+	require.ErrorContains(t, err, fmt.Sprintf("\"%s\" not found", utils.ChecksumsFile))
+}
+
+func TestPull_ChecksumsOfOddNames(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	dir := t.TempDir()
+	files := map[string]string{}
+	for _, name := range []string{"new\nline", "  lead"} {
+		files[name] = filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(files[name], []byte(name), 0644))
+	}
+	common := []Option{
+		WithContext(t.Context()),
+		WithRepository("dir:" + filepath.Join(t.TempDir(), "cache")),
+		WithTag("main"),
+	}
+	_, err := PushWithResult(append(common, WithFiles(files), WithWorkdir(dir))...)
+	require.NoError(t, err)
+	result, err := PullWithResult(append(common, WithWorkdir(t.TempDir()))...)
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Files)
+}
+
+func TestPull_Collision(t *testing.T) {
+	foo, _ := filepath.Abs("../testdata/foo")
+	common := []Option{
+		WithContext(t.Context()),
+		WithRepository("dir:" + filepath.Join(t.TempDir(), "cache")),
+		WithTagLength(16),
+	}
+	pushed, err := PushWithResult(append(common, WithKeys([]string{"a"}), WithFiles(map[string]string{"foo": foo}))...)
+	require.NoError(t, err)
+	assert.Len(t, pushed.Tag, 16)
+
+	// the cache image of "a" tagged as if it is the one of "b"
+	tag, err := ComputeTag(append(common, WithKeys([]string{"b"}))...)
+	require.NoError(t, err)
+	backend, err := newOptions(common...).storage()
+	require.NoError(t, err)
+	img, err := backend.Get(t.Context(), pushed.Tag)
+	require.NoError(t, err)
+	require.NoError(t, backend.Put(t.Context(), tag, img))
+
+	workdir := t.TempDir()
+	result, err := PullWithResult(append(common, WithKeys([]string{"b"}), WithWorkdir(workdir))...)
+	require.ErrorIs(t, err, ErrCacheMiss)
+	assert.Equal(t, StatusMiss, result.Status)
+	_, err = os.Stat(filepath.Join(workdir, "foo"))
+	assert.True(t, os.IsNotExist(err))
+
+	result, err = PullWithResult(append(common, WithTag(tag), WithWorkdir(workdir))...)
+	require.NoError(t, err)
+	assert.Equal(t, StatusHit, result.Status)
+
+	_, err = ComputeTag(append(common, WithTagLength(3))...)
+	require.Error(t, err)
+}
+
+func TestPull_HashScheme(t *testing.T) {
+	// paths of dep files are relative to the workdir with v2, which is the same for all
+	dir := t.TempDir()
+	foo := filepath.Join(dir, "foo")
+	require.NoError(t, os.WriteFile(foo, []byte("bar"), 0644))
+	common := []Option{
+		WithContext(t.Context()),
+		WithRepository("dir:" + filepath.Join(t.TempDir(), "cache")),
+		WithTagPrefix("app"),
+		WithWorkdir(dir),
+		WithDepFiles(map[string]string{"foo": foo}),
+	}
+	v1Pushed, err := PushWithResult(append(common, WithFiles(map[string]string{"foo": foo}))...)
+	require.NoError(t, err)
+	v2Pushed, err := PushWithResult(append(common, WithHashScheme(utils.HashSchemeV2), WithFiles(map[string]string{"foo": foo}))...)
+	require.NoError(t, err)
+	assert.Equal(t, utils.HashSchemeV1, utils.TagScheme(v1Pushed.Tag))
+	assert.Equal(t, utils.HashSchemeV2, utils.TagScheme(v2Pushed.Tag))
+
+	result, err := PullWithResult(append(common, WithHashScheme(utils.HashSchemeV2))...)
+	require.NoError(t, err)
+	assert.Equal(t, v2Pushed.Tag, result.Tag)
+
+	// restore keys only match cache images of the same scheme
+	result, err = PullWithResult(append(common,
+		WithKeys([]string{"changed"}),
+		WithRestoreKeys([]string{"app-"}),
+	)...)
+	require.NoError(t, err)
+	assert.Equal(t, StatusPartial, result.Status)
+	assert.Equal(t, v1Pushed.Tag, result.Tag)
+
+	// the cache image of v1 tagged as if it is the one of v2
+	backend, err := newOptions(common...).storage()
+	require.NoError(t, err)
+	img, err := backend.Get(t.Context(), v1Pushed.Tag)
+	require.NoError(t, err)
+	require.NoError(t, backend.Put(t.Context(), v2Pushed.Tag, img))
+	_, err = PullWithResult(append(common, WithHashScheme(utils.HashSchemeV2))...)
+	require.ErrorIs(t, err, ErrCacheMiss)
+}
@@ -2,136 +2,210 @@ package api
 
 import (
 	"bytes"
-	"context"
-	"crypto/tls"
 	"fmt"
 	"log/slog"
-	"net/http"
+	"maps"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/goccy/go-yaml"
-	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/crane"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/empty"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
-	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/ssuf1998dev/container-registry-as-cache/internal/tarhelper"
 	"github.com/ssuf1998dev/container-registry-as-cache/internal/utils"
 )
 
 func Push(opts ...Option) error {
-	o := &options{
-		context:  context.Background(),
-		keys:     []string{},
-		depFiles: map[string]string{},
-		files:    map[string]string{},
-	}
-	for _, option := range opts {
-		option(o)
-	}
-
-	_, err := push(o)
+	_, err := PushWithResult(opts...)
 	return err
 }
 
-func push(opts *options) (image []byte, err error) {
-	base := empty.Image
+// PushWithResult is like Push but tells whether the cache image is pushed or skipped.
+func PushWithResult(opts ...Option) (*Result, error) {
+	result, _, err := push(newOptions(opts...))
+	return result, err
+}
+
+func push(opts *options) (result *Result, image []byte, err error) {
+	start := time.Now()
+	result = &Result{}
+	defer func() {
+		result.Timing.Total = time.Since(start)
+	}()
 
 	if len(opts.files) == 0 {
-		return nil, fmt.Errorf("empty image is not allowed")
+		return result, nil, fmt.Errorf("empty image is not allowed")
 	}
 
-	tag := opts.tag
-	var keys []string
-	if len(tag) == 0 {
-		keys = append(keys, opts.keys...)
-		if len(opts.platform) > 0 {
-			keys = append(keys, opts.platform)
-		}
-		tag, err = utils.ComputeTag(opts.depFiles, keys, opts.workdir)
-		if err != nil {
-			return nil, err
-		}
-	}
-	repo := opts.repo
-	if len(repo) == 0 {
-		repo = fmt.Sprintf("%s/%s", name.DefaultRegistry, utils.Crac)
+	tag, keys, err := opts.computeTag()
+	if err != nil {
+		return result, nil, err
 	}
-	nameOpts := []name.Option{}
-	if opts.forceHttp {
-		nameOpts = append(nameOpts, name.Insecure)
+	backend, err := opts.storage()
+	if err != nil {
+		return result, nil, err
 	}
-	ref, err := name.ParseReference(fmt.Sprintf("%s:%s", repo, tag), nameOpts...)
+	ref, err := opts.tarballReference(backend, tag)
 	if err != nil {
-		return nil, err
+		return result, nil, err
 	}
+	result.Tag, result.Reference = tag, backend.Reference(tag)
 
-	transport := remote.DefaultTransport.(*http.Transport)
-	if opts.insecure {
-		transport = transport.Clone()
-		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	if !opts.forcePush && !opts.skipUnchanged {
+		if digest, ok, err := backend.Exists(opts.context, tag); err == nil && ok {
+			slog.Warn("cache image exists, skip", "tag", tag, "digest", digest)
+			result.Status = StatusSkipped
+			result.Digest = digest.String()
+			result.Timing.Resolve = time.Since(start)
+			return result, nil, nil
+		}
 	}
+	result.Timing.Resolve = time.Since(start)
 
-	if !opts.forcePush {
-		remoteGetOpts := []remote.Option{
-			remote.WithContext(opts.context),
-			remote.WithTransport(transport),
+	base, err := opts.resolveBase(backend)
+	if err != nil {
+		return result, nil, err
+	}
+	if name, ok := whiteoutFile(opts.files); ok && base != nil {
+		slog.Warn("a file is named like a whiteout, pushing full layers", "file", name)
+		base = nil
+	}
+	img := empty.Image
+	digests := []v1.Hash{}
+	built := []cacheContent{}
+	// contents tell all files of the cache image for the meta
+	var contents []cacheContent
+	chain := utils.CracMeta{}
+	if base != nil {
+		slog.Info("making delta layer...", "files", len(opts.files), "base", base.tag)
+		delta, err := utils.NewDeltaLayer(opts.files, opts.workdir, opts.tarOptions(), base.checksums, base.entries)
+		if err != nil {
+			return result, nil, err
+		}
+		for _, layer := range base.layers {
+			digest, err := layer.Digest()
+			if err != nil {
+				return result, nil, err
+			}
+			digests = append(digests, digest)
+		}
+		img, _ = mutate.AppendLayers(img, base.layers...)
+		contents = []cacheContent{delta}
+		chain.Base, chain.Depth = base.meta.Base, base.meta.Depth
+		if delta.Empty() {
+			slog.Info("nothing changed since base, reusing its layers", "base", base.tag)
+		} else {
+			built = append(built, delta)
+			chain.Base, chain.Depth = base.tag, base.meta.Depth+1
+			slog.Info("delta layer files", "changed", delta.Files(), "deleted", delta.Deleted())
 		}
-		if len(opts.username) != 0 && len(opts.password) != 0 {
-			remoteGetOpts = append(remoteGetOpts, remote.WithAuth(&authn.Basic{Username: opts.username, Password: opts.password}))
+	} else {
+		slog.Info("making cache layers...", "files", len(opts.files), "split", opts.split.Mode)
+		layers, err := utils.NewTarLayers(opts.files, opts.workdir, opts.tarOptions(), opts.split)
+		if err != nil {
+			return result, nil, err
 		}
-		if desc, err := remote.Get(ref, remoteGetOpts...); err == nil {
-			slog.Warn("cache image exists, skip", "tag", tag, "digest", desc.Digest)
-			return nil, nil
+		for _, layer := range layers {
+			built = append(built, layer)
 		}
+		contents = built
 	}
+	for _, cacheLayer := range built {
+		// files are read once here for digest, and once more while writing
+		digest, err := cacheLayer.Digest()
+		if err != nil {
+			return result, nil, err
+		}
+		size, _ := cacheLayer.Size()
+		usize, _ := cacheLayer.UncompressedSize()
+		result.CompressedSize += size
+		result.UncompressedSize += usize
+		result.Files += cacheLayer.Files()
+		img, _ = mutate.AppendLayers(img, cacheLayer)
+		digests = append(digests, digest)
+		slog.Info("cache layer done", "digest", digest, "files", cacheLayer.Files(), "size", humanize.Bytes(uint64(size)))
+	}
+	result.Timing.Archive = time.Since(start) - result.Timing.Resolve
 
-	slog.Info("making cache layer...", "files", len(opts.files))
-	cacheLayer, err := utils.NewTarLayer(opts.files, opts.workdir)
-	defer func() {
-		os.Remove(cacheLayer.File)
-	}()
-	if err != nil {
-		return nil, err
+	if opts.skipUnchanged {
+		stored, err := backend.Get(opts.context, tag)
+		switch {
+		case err == nil:
+			storedDigests, err := cacheLayerDigests(stored)
+			if err != nil {
+				return result, nil, err
+			}
+			if slices.Equal(storedDigests, digests) {
+				slog.Info("cache layers unchanged, skip", "tag", tag, "digests", digests)
+				result.Status = StatusSkipped
+				if storedDigest, err := stored.Digest(); err == nil {
+					result.Digest = storedDigest.String()
+				}
+				return result, nil, nil
+			}
+			slog.Info("cache layers changed, pushing", "tag", tag, "digests", digests, "stored", storedDigests)
+		case isNotFound(err):
+			slog.Info("cache image not found, pushing", "tag", tag)
+		default:
+			return result, nil, err
+		}
 	}
-	img, _ := mutate.AppendLayers(base, cacheLayer)
-	slog.Info("cache layer done")
 
-	meta, _ := yaml.Marshal(utils.CracMeta{
-		Version: utils.CracVersion.String(),
-	})
-	metaLayer, _ := crane.Layer(map[string][]byte{fmt.Sprintf("/%s/meta.yaml", utils.Crac): meta})
+	metaFiles, err := opts.metaFiles(chain, contents)
+	if err != nil {
+		return result, nil, err
+	}
+	metaLayer, _ := crane.Layer(metaFiles)
 	img, _ = mutate.AppendLayers(img, metaLayer)
 	slog.Info("meta layer generated", "version", utils.CracVersion.String())
 
 	cf, _ := img.ConfigFile()
 	cf = cf.DeepCopy()
 	cf.Created = v1.Time{Time: time.Now()}
-	cf.History = []v1.History{
-		{Created: cf.Created, CreatedBy: utils.CreatedByCracCopy},
-		{Created: cf.Created, CreatedBy: utils.CreatedByCracMeta},
+	if t, ok := utils.SourceDateEpoch(); ok && opts.reproducible {
+		cf.Created = v1.Time{Time: t}
 	}
+	cf.History = []v1.History{}
+	for range digests {
+		cf.History = append(cf.History, v1.History{Created: cf.Created, CreatedBy: utils.CreatedByCracCopy})
+	}
+	cf.History = append(cf.History, v1.History{Created: cf.Created, CreatedBy: utils.CreatedByCracMeta})
 	img, _ = mutate.ConfigFile(img, cf)
 
-	slog.Info("reference", "repo", repo, "tag", tag, "keys", strings.Join(keys, ", "), "depFiles", len(opts.depFiles))
+	slog.Info("reference", "repo", opts.repoName(), "tag", tag, "keys", strings.Join(keys, ", "), "depFiles", len(opts.depFiles))
 	imgSize, _ := utils.CompressedImageSize(img)
+	if imgDigest, err := img.Digest(); err == nil {
+		result.Digest = imgDigest.String()
+	}
+	transferStart := time.Now()
+	written := func() (*Result, []byte, error) {
+		result.Status = StatusPushed
+		result.Timing.Transfer = time.Since(transferStart)
+		return result, image, nil
+	}
 
 	if opts.outputStdout {
-		err := tarball.Write(ref, img, os.Stdout)
-		return nil, err
+		if err := tarball.Write(ref, img, os.Stdout); err != nil {
+			return result, nil, err
+		}
+		return written()
 	}
 
 	if opts.outputBytes {
 		var buf bytes.Buffer
 		if err := tarball.Write(ref, img, &buf); err != nil {
-			return nil, err
+			return result, nil, err
 		}
-		return buf.Bytes(), nil
+		image = buf.Bytes()
+		return written()
 	}
 
 	if len(opts.outputFile) != 0 {
@@ -142,51 +216,144 @@ func push(opts *options) (image []byte, err error) {
 		)
 		f, err := os.OpenFile(opts.outputFile, os.O_CREATE|os.O_RDWR, 0644)
 		if err != nil {
-			return nil, err
+			return result, nil, err
+		}
+		defer f.Close()
+		if err := tarball.Write(ref, img, f); err != nil {
+			return result, nil, err
 		}
-		err = tarball.Write(ref, img, f)
 		slog.Info("image wrote")
+		return written()
+	}
+
+	if bc := opts.blobCache(backend); bc != nil {
+		// layers are written into the blob cache while being uploaded
+		img = bc.Image(img)
+	}
+	if rb, ok := backend.(*registryBackend); ok {
+		if img, result.SavedSize, err = rb.dedupe(opts.context, img); err != nil {
+			return result, nil, err
+		}
+	}
+	slog.Info("writing the image to backend...", "reference", result.Reference, "bsize", imgSize, "size", humanize.Bytes(uint64(imgSize)))
+	if err := backend.Put(opts.context, tag, img); err != nil {
+		return result, nil, err
+	}
+	slog.Info("image wrote", "saved", humanize.Bytes(uint64(result.SavedSize)))
+	return written()
+}
+
+// tarballReference returns the reference recorded in tarballs, a plain "crac:<tag>"
+// if the backend is not a registry.
+func (o *options) tarballReference(backend Backend, tag string) (name.Reference, error) {
+	if _, ok := backend.(*registryBackend); ok {
+		return o.reference(tag)
+	}
+	return name.NewTag(fmt.Sprintf("%s:%s", utils.Crac, tag))
+}
+
+// cacheContent is a cache layer made by pushing, a full utils.TarLayer or a utils.DeltaLayer.
+type cacheContent interface {
+	v1.Layer
+	Files() int
+	UncompressedSize() (int64, error)
+	Checksums() (map[string]string, error)
+	Entries() (map[string]utils.EntryMeta, error)
+	RegularFiles() (int, int64, error)
+}
+
+// metaFiles returns meta.yaml, the per-file checksum manifest and the entry list of the meta
+// layer, counts, checksums and entries are of all contents, chain tells the base and the depth of delta layers.
+func (o *options) metaFiles(chain utils.CracMeta, contents []cacheContent) (map[string][]byte, error) {
+	meta := utils.CracMeta{
+		Version:  utils.CracVersion.String(),
+		Keys:     o.keys,
+		Platform: o.platform,
+		CI:       utils.ReadCI(),
+		Base:     chain.Base,
+		Depth:    chain.Depth,
+	}
+	var err error
+	if len(o.tag) == 0 {
+		if meta.Hash, _, err = o.computeHash(); err != nil {
+			return nil, err
+		}
+		meta.HashScheme = o.hashSchemeOrDefault()
+	}
+	if meta.DepFiles, err = utils.HashDepFiles(o.depFiles, o.workdir); err != nil {
 		return nil, err
 	}
+	checksums := map[string]string{}
+	entries := map[string]utils.EntryMeta{}
+	for _, content := range contents {
+		files, size, err := content.RegularFiles()
+		if err != nil {
+			return nil, err
+		}
+		meta.Files += files
+		meta.Size += size
+		sums, err := content.Checksums()
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(checksums, sums)
+		contentEntries, err := content.Entries()
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(entries, contentEntries)
+	}
+	meta.Hostname, _ = os.Hostname()
 
-	slog.Info("writing the image to remote registry...", "bsize", imgSize, "size", humanize.Bytes(uint64(imgSize)))
-	updates := make(chan v1.Update)
-	go func() {
-		last := time.Unix(0, 0)
-		for {
-			u, ok := <-updates
-			if !ok {
-				break
-			}
-			if u.Error != nil {
-				break
-			}
-			if u.Complete >= u.Total {
-				continue
-			}
-			if time.Since(last).Abs() >= 1000*time.Millisecond {
-				slog.Info(
-					"image writing...",
-					"progress", float64(u.Complete)/float64(u.Total),
-					"complete", u.Complete,
-					"total", u.Total,
-				)
-				last = time.Now()
-			}
+	metaData, err := yaml.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	var sums bytes.Buffer
+	if err := utils.WriteChecksums(&sums, checksums); err != nil {
+		return nil, err
+	}
+	var entryList bytes.Buffer
+	if err := utils.WriteEntries(&entryList, entries); err != nil {
+		return nil, err
+	}
+	return map[string][]byte{
+		fmt.Sprintf("/%s/meta.yaml", utils.Crac):               metaData,
+		fmt.Sprintf("/%s/%s", utils.Crac, utils.ChecksumsFile): sums.Bytes(),
+		fmt.Sprintf("/%s/%s", utils.Crac, utils.EntriesFile):   entryList.Bytes(),
+	}, nil
+}
+
+// whiteoutFile returns a file named like a whiteout, which a delta layer could not tell from one.
+func whiteoutFile(files map[string]string) (string, bool) {
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		if _, ok := tarhelper.IsWhiteout(filepath.ToSlash(name)); ok {
+			return name, true
 		}
-	}()
-	remoteWriteOpts := []remote.Option{
-		remote.WithContext(opts.context),
-		remote.WithTransport(transport),
-		remote.WithProgress(updates),
 	}
-	if len(opts.username) != 0 && len(opts.password) != 0 {
-		remoteWriteOpts = append(remoteWriteOpts, remote.WithAuth(&authn.Basic{Username: opts.username, Password: opts.password}))
+	return "", false
+}
+
+// cacheLayerDigests returns digests of the cache layers found by CRACCOPY history entries.
+func cacheLayerDigests(img v1.Image) ([]v1.Hash, error) {
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
 	}
-	err = remote.Write(ref, img, remoteWriteOpts...)
+	layers, err := img.Layers()
 	if err != nil {
 		return nil, err
 	}
-	slog.Info("image wrote")
-	return nil, nil
+	digests := []v1.Hash{}
+	for i, h := range cf.History {
+		if h.CreatedBy != utils.CreatedByCracCopy || i >= len(layers) {
+			continue
+		}
+		digest, err := layers[i].Digest()
+		if err != nil {
+			return nil, err
+		}
+		digests = append(digests, digest)
+	}
+	return digests, nil
 }
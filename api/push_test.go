@@ -5,10 +5,14 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/goccy/go-yaml"
 	"github.com/google/go-containerregistry/pkg/authn"
@@ -16,6 +20,7 @@ import (
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/ssuf1998dev/container-registry-as-cache/internal/registry"
 	"github.com/ssuf1998dev/container-registry-as-cache/internal/tarhelper"
 	"github.com/ssuf1998dev/container-registry-as-cache/internal/utils"
 	"github.com/stretchr/testify/assert"
@@ -23,7 +28,7 @@ import (
 )
 
 func TestPush_Local(t *testing.T) {
-	data, err := push(&options{
+	_, data, err := push(&options{
 		context:     t.Context(),
 		depFiles:    map[string]string{"../testdata/foo": "../testdata/foo"},
 		files:       map[string]string{"../testdata/foo": "../testdata/foo"},
@@ -54,13 +59,21 @@ func TestPush_Local(t *testing.T) {
 	metaLayer := layers[metaIndex]
 	metaReader, _ := metaLayer.Uncompressed()
 	var meta utils.CracMeta
-	tarhelper.WalkTar(metaReader, func(header *tar.Header, fi os.FileInfo, data []byte) (bool, error) {
+	tarhelper.WalkTar(metaReader, func(header *tar.Header, fi os.FileInfo, r io.Reader) (bool, error) {
 		if header.Name == fmt.Sprintf("/%s/meta.yaml", utils.Crac) {
-			return true, yaml.Unmarshal(data, &meta)
+			return true, yaml.NewDecoder(r).Decode(&meta)
 		}
 		return false, nil
 	})
 	assert.Equal(t, utils.CracVersion.String(), meta.Version)
+	assert.Len(t, meta.Hash, 64)
+	assert.True(t, strings.HasPrefix(meta.Hash, "bd142ccf"))
+	assert.Equal(t, []utils.DepFile{{
+		Path:   "../testdata/foo",
+		Sha256: "fcde2b2edba56bf408601fb721fe9b5c338d10ee429ea04fae5511b68fbf8fb9",
+	}}, meta.DepFiles)
+	assert.Equal(t, 1, meta.Files)
+	assert.Equal(t, int64(3), meta.Size)
 }
 
 func TestPush_Local_Pnpm(t *testing.T) {
@@ -71,7 +84,7 @@ func TestPush_Local_Pnpm(t *testing.T) {
 	files := utils.ScanFiles([]string{filepath.Join(basepath, ".pnpm/store/**")})
 	assert.Greater(t, len(files), 0)
 
-	_, err := push(&options{
+	_, _, err := push(&options{
 		context:     t.Context(),
 		depFiles:    depFiles,
 		files:       files,
@@ -84,14 +97,11 @@ func TestPush_Local_Pnpm(t *testing.T) {
 func TestPush_Remote(t *testing.T) {
 	os.Unsetenv("HTTP_PROXY")
 	os.Unsetenv("http_proxy")
-	reg := os.Getenv("CRAC_TEST_REGISTRY")
-	if reg == "" {
-		t.Skipf("registry is empty, skip")
-	}
+	repo := testRegistryRepo(t)
 
-	_, err := push(&options{
+	_, _, err := push(&options{
 		context:   t.Context(),
-		repo:      fmt.Sprintf("%s/%s", reg, utils.Crac),
+		repo:      repo,
 		username:  "testuser",
 		password:  "testpassword",
 		forceHttp: true,
@@ -102,11 +112,309 @@ func TestPush_Remote(t *testing.T) {
 	})
 	require.NoError(t, err)
 
-	repo, _ := name.NewRepository(fmt.Sprintf("%s/%s", reg, utils.Crac), name.Insecure)
+	repository, _ := name.NewRepository(repo, name.Insecure)
 	tags, err := remote.List(
-		repo,
+		repository,
 		remote.WithAuth(&authn.Basic{Username: "testuser", Password: "testpassword"}),
 	)
 	require.NoError(t, err)
 	assert.Equal(t, "bd142ccf", tags[0])
 }
+
+func TestPush_Reproducible(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+	dir := t.TempDir()
+	foo := filepath.Join(dir, "foo")
+	require.NoError(t, os.WriteFile(foo, []byte("bar"), 0644))
+
+	digests := []string{}
+	for _, mtime := range []time.Time{time.Now(), time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)} {
+		require.NoError(t, os.Chtimes(foo, mtime, mtime))
+		result, err := PushWithResult(
+			WithContext(t.Context()),
+			WithRepository("oci:"+filepath.Join(t.TempDir(), "cache")),
+			WithWorkdir(dir),
+			WithFiles(map[string]string{"foo": foo}),
+			WithReproducible(true),
+		)
+		require.NoError(t, err)
+		digests = append(digests, result.Digest)
+	}
+	assert.Equal(t, digests[0], digests[1])
+}
+
+func TestPush_SkipUnchanged(t *testing.T) {
+	dir := t.TempDir()
+	foo := filepath.Join(dir, "foo")
+	require.NoError(t, os.WriteFile(foo, []byte("bar"), 0644))
+	common := []Option{
+		WithContext(t.Context()),
+		WithRepository("dir:" + filepath.Join(t.TempDir(), "cache")),
+		WithWorkdir(dir),
+		WithTag("fixed"),
+		WithFiles(map[string]string{"foo": foo}),
+		WithReproducible(true),
+		WithForcePush(true),
+		WithSkipUnchanged(true),
+	}
+
+	pushed, err := PushWithResult(common...)
+	require.NoError(t, err)
+	assert.Equal(t, StatusPushed, pushed.Status)
+
+	require.NoError(t, os.Chtimes(foo, time.Now(), time.Now()))
+	skipped, err := PushWithResult(common...)
+	require.NoError(t, err)
+	assert.Equal(t, StatusSkipped, skipped.Status)
+	assert.Equal(t, pushed.Digest, skipped.Digest)
+
+	require.NoError(t, os.WriteFile(foo, []byte("baz"), 0644))
+	changed, err := PushWithResult(common...)
+	require.NoError(t, err)
+	assert.Equal(t, StatusPushed, changed.Status)
+	assert.NotEqual(t, pushed.Digest, changed.Digest)
+}
+
+func TestPush_MountFrom(t *testing.T) {
+	handler, err := registry.New(registry.Options{})
+	require.NoError(t, err)
+	// blobs of the in-process registry are shared by repositories, hide them from the
+	// repositories pushed to, so layers are looked up in mount sources
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead && !strings.HasPrefix(r.URL.Path, "/v2/source/blobs/") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	dir := t.TempDir()
+	foo := filepath.Join(dir, "foo")
+	require.NoError(t, os.WriteFile(foo, []byte("bar"), 0644))
+	common := []Option{
+		WithContext(t.Context()),
+		WithForceHttp(true),
+		WithWorkdir(dir),
+		WithFiles(map[string]string{"foo": foo}),
+		WithReproducible(true),
+		WithForcePush(true),
+	}
+
+	source, err := PushWithResult(append(common, WithRepository(host+"/source"))...)
+	require.NoError(t, err)
+	assert.Zero(t, source.SavedSize)
+
+	mounted, err := PushWithResult(append(common, WithRepository(host+"/mounted"), WithMountFrom([]string{host + "/source"}))...)
+	require.NoError(t, err)
+	assert.Equal(t, StatusPushed, mounted.Status)
+	assert.Greater(t, mounted.SavedSize, mounted.CompressedSize)
+
+	uploaded, err := PushWithResult(append(common, WithRepository(host+"/uploaded"))...)
+	require.NoError(t, err)
+	assert.Zero(t, uploaded.SavedSize)
+
+	_, err = PushWithResult(append(common, WithRepository(host+"/mounted"), WithMountFrom([]string{"example.com/source"}))...)
+	require.ErrorContains(t, err, "is not on registry")
+}
+
+func TestPush_Split(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{}
+	for name, content := range map[string]string{"r": "r", "a/x": "x", "a/y": "y", "b/z": "z"} {
+		p := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, os.WriteFile(p, []byte(content), 0644))
+		files[name] = p
+	}
+	common := []Option{
+		WithContext(t.Context()),
+		WithRepository("dir:" + filepath.Join(t.TempDir(), "cache")),
+		WithWorkdir(dir),
+		WithTag("fixed"),
+		WithFiles(files),
+		WithReproducible(true),
+		WithForcePush(true),
+		WithLayerSplit(utils.SplitDir),
+	}
+	cacheDigests := func() []string {
+		inspection, err := Inspect(common...)
+		require.NoError(t, err)
+		digests := []string{}
+		for _, l := range inspection.Layers {
+			if l.CreatedBy == utils.CreatedByCracCopy {
+				digests = append(digests, l.Digest)
+			}
+		}
+		return digests
+	}
+
+	pushed, err := PushWithResult(common...)
+	require.NoError(t, err)
+	assert.Equal(t, 4, pushed.Files)
+	before := cacheDigests()
+	require.Len(t, before, 3)
+
+	require.NoError(t, os.WriteFile(files["b/z"], []byte("zz"), 0644))
+	_, err = PushWithResult(common...)
+	require.NoError(t, err)
+	after := cacheDigests()
+	require.Len(t, after, 3)
+	assert.Equal(t, before[:2], after[:2])
+	assert.NotEqual(t, before[2], after[2])
+
+	for _, atomic := range []bool{false, true} {
+		out := t.TempDir()
+		result, err := PullWithResult(append(common, WithWorkdir(out), WithAtomic(atomic))...)
+		require.NoError(t, err)
+		assert.Equal(t, 4, result.Files)
+		b, err := os.ReadFile(filepath.Join(out, "b/z"))
+		require.NoError(t, err)
+		assert.Equal(t, "zz", string(b))
+		b, err = os.ReadFile(filepath.Join(out, "a/y"))
+		require.NoError(t, err)
+		assert.Equal(t, "y", string(b))
+	}
+}
+
+func TestPush_Base(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, content string) {
+		p := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, os.WriteFile(p, []byte(content), 0644))
+	}
+	write("r", "r")
+	write("a/x", "x")
+	write("a/y", "y")
+	write("b/z", "z")
+	write("bin", "bin")
+	require.NoError(t, os.Chmod(filepath.Join(dir, "bin"), 0644))
+	require.NoError(t, os.Symlink("r", filepath.Join(dir, "l")))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "e"), 0755))
+	repo := "dir:" + filepath.Join(t.TempDir(), "cache")
+	common := func(tag string, names ...string) []Option {
+		files := map[string]string{}
+		for _, name := range names {
+			files[name] = filepath.Join(dir, name)
+		}
+		return []Option{
+			WithContext(t.Context()),
+			WithRepository(repo),
+			WithWorkdir(dir),
+			WithTag(tag),
+			WithFiles(files),
+			WithForcePush(true),
+		}
+	}
+	cacheLayerCount := func(tag string) (int, map[string]any) {
+		inspection, err := Inspect(WithContext(t.Context()), WithRepository(repo), WithTag(tag))
+		require.NoError(t, err)
+		count := 0
+		for _, l := range inspection.Layers {
+			if l.CreatedBy == utils.CreatedByCracCopy {
+				count++
+			}
+		}
+		return count, inspection.Meta
+	}
+
+	_, err := PushWithResult(append(common("t1", "r", "a/x", "a/y", "b/z", "bin", "l", "e"), WithBase("t"))...)
+	require.NoError(t, err)
+	count, meta := cacheLayerCount("t1")
+	assert.Equal(t, 1, count)
+	assert.Nil(t, meta["depth"])
+
+	write("a/x", "xx")
+	write("c", "c")
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, "b")))
+	// only the mode changes, and a symlink and a directory are deleted
+	require.NoError(t, os.Chmod(filepath.Join(dir, "bin"), 0755))
+	require.NoError(t, os.Remove(filepath.Join(dir, "l")))
+	require.NoError(t, os.Remove(filepath.Join(dir, "e")))
+	pushed, err := PushWithResult(append(common("t2", "r", "a/x", "a/y", "c", "bin"), WithBase("t1"))...)
+	require.NoError(t, err)
+	assert.Equal(t, 3, pushed.Files)
+	count, meta = cacheLayerCount("t2")
+	assert.Equal(t, 2, count)
+	assert.EqualValues(t, 1, meta["depth"])
+	assert.Equal(t, "t1", meta["base"])
+
+	for _, atomic := range []bool{false, true} {
+		out := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(out, "b"), 0755))
+		result, err := PullWithResult(append(common("t2"), WithWorkdir(out), WithAtomic(atomic))...)
+		require.NoError(t, err)
+		assert.Equal(t, 5, result.Files)
+		b, err := os.ReadFile(filepath.Join(out, "a/x"))
+		require.NoError(t, err)
+		assert.Equal(t, "xx", string(b))
+		b, err = os.ReadFile(filepath.Join(out, "a/y"))
+		require.NoError(t, err)
+		assert.Equal(t, "y", string(b))
+		assert.NoFileExists(t, filepath.Join(out, "b/z"))
+		fi, err := os.Stat(filepath.Join(out, "bin"))
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0755), fi.Mode().Perm())
+		_, err = os.Lstat(filepath.Join(out, "l"))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+		assert.NoDirExists(t, filepath.Join(out, "e"))
+	}
+
+	write("a/y", "yy")
+	_, err = PushWithResult(append(common("t3", "r", "a/x", "a/y", "c", "bin"), WithBase("t2"), WithMaxDepth(1))...)
+	require.NoError(t, err)
+	count, meta = cacheLayerCount("t3")
+	assert.Equal(t, 1, count)
+	assert.Nil(t, meta["depth"])
+
+	// only a base not found is looked up as a prefix, a broken one fails
+	require.NoError(t, os.WriteFile(filepath.Join(strings.TrimPrefix(repo, "dir:"), "t.tar"), []byte("broken"), 0644))
+	_, err = PushWithResult(append(common("t4", "r", "a/x", "a/y", "c", "bin"), WithBase("t"))...)
+	require.Error(t, err)
+}
+
+func TestPush_Base_WhiteoutName(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"x", ".wh.x", "d/.wh.y", "d/y"} {
+		p := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, os.WriteFile(p, []byte(name), 0644))
+	}
+	repo := "dir:" + filepath.Join(t.TempDir(), "cache")
+	common := func(tag string) []Option {
+		files := map[string]string{}
+		for _, name := range []string{"x", ".wh.x", "d/.wh.y", "d/y"} {
+			files[name] = filepath.Join(dir, name)
+		}
+		return []Option{
+			WithContext(t.Context()),
+			WithRepository(repo),
+			WithWorkdir(dir),
+			WithTag(tag),
+			WithFiles(files),
+		}
+	}
+
+	// files named like whiteouts are content of a full cache image
+	_, err := PushWithResult(common("t1")...)
+	require.NoError(t, err)
+	_, err = PushWithResult(append(common("t2"), WithBase("t1"))...)
+	require.NoError(t, err)
+	inspection, err := Inspect(WithContext(t.Context()), WithRepository(repo), WithTag("t2"))
+	require.NoError(t, err)
+	assert.Nil(t, inspection.Meta["depth"])
+
+	for _, tag := range []string{"t1", "t2"} {
+		out := t.TempDir()
+		result, err := PullWithResult(append(common(tag), WithWorkdir(out))...)
+		require.NoError(t, err)
+		assert.Equal(t, 4, result.Files)
+		for _, name := range []string{"x", ".wh.x", "d/.wh.y", "d/y"} {
+			b, err := os.ReadFile(filepath.Join(out, name))
+			require.NoError(t, err)
+			assert.Equal(t, name, string(b))
+		}
+	}
+}
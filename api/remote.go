@@ -0,0 +1,184 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/ssuf1998dev/container-registry-as-cache/internal/utils"
+)
+
+func (o *options) repoName() string {
+	_, repo := parseRepository(o.repo)
+	if len(repo) == 0 {
+		return fmt.Sprintf("%s/%s", name.DefaultRegistry, utils.Crac)
+	}
+	return repo
+}
+
+func (o *options) nameOptions() []name.Option {
+	nameOpts := []name.Option{}
+	if o.forceHttp {
+		nameOpts = append(nameOpts, name.Insecure)
+	}
+	return nameOpts
+}
+
+func (o *options) repository() (name.Repository, error) {
+	return name.NewRepository(o.repoName(), o.nameOptions()...)
+}
+
+func (o *options) reference(tag string) (name.Reference, error) {
+	return name.ParseReference(fmt.Sprintf("%s:%s", o.repoName(), tag), o.nameOptions()...)
+}
+
+func (o *options) remoteOptions(extra ...remote.Option) []remote.Option {
+	transport := remote.DefaultTransport.(*http.Transport)
+	if o.insecure {
+		transport = transport.Clone()
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	remoteOpts := []remote.Option{
+		remote.WithContext(o.context),
+		remote.WithTransport(transport),
+	}
+	// explicit username and password win over docker config and credential helpers
+	if len(o.username) != 0 && len(o.password) != 0 {
+		remoteOpts = append(remoteOpts, remote.WithAuth(&authn.Basic{Username: o.username, Password: o.password}))
+	} else if o.keychain != nil {
+		remoteOpts = append(remoteOpts, remote.WithAuthFromKeychain(o.keychain))
+	} else {
+		remoteOpts = append(remoteOpts, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	}
+	return append(remoteOpts, extra...)
+}
+
+// registryBackend stores cache images in a repository of an OCI distribution registry.
+type registryBackend struct {
+	o *options
+}
+
+func (b *registryBackend) Get(ctx context.Context, tag string) (v1.Image, error) {
+	ref, err := b.o.reference(tag)
+	if err != nil {
+		return nil, err
+	}
+	img, err := remote.Image(ref, b.o.remoteOptions(remote.WithContext(ctx))...)
+	if isNotFound(err) {
+		return nil, fmt.Errorf("%w, %s", ErrNotFound, err)
+	}
+	return img, err
+}
+
+func (b *registryBackend) Put(ctx context.Context, tag string, img v1.Image) error {
+	ref, err := b.o.reference(tag)
+	if err != nil {
+		return err
+	}
+	updates := make(chan v1.Update)
+	go func() {
+		last := time.Unix(0, 0)
+		for {
+			u, ok := <-updates
+			if !ok {
+				break
+			}
+			if u.Error != nil {
+				break
+			}
+			if u.Complete >= u.Total {
+				continue
+			}
+			if time.Since(last).Abs() >= 1000*time.Millisecond {
+				slog.Info(
+					"image writing...",
+					"progress", float64(u.Complete)/float64(u.Total),
+					"complete", u.Complete,
+					"total", u.Total,
+				)
+				last = time.Now()
+			}
+		}
+	}()
+	return remote.Write(ref, img, b.o.remoteOptions(remote.WithContext(ctx), remote.WithProgress(updates))...)
+}
+
+func (b *registryBackend) Exists(ctx context.Context, tag string) (v1.Hash, bool, error) {
+	ref, err := b.o.reference(tag)
+	if err != nil {
+		return v1.Hash{}, false, err
+	}
+	desc, err := remote.Get(ref, b.o.remoteOptions(remote.WithContext(ctx))...)
+	if isNotFound(err) {
+		return v1.Hash{}, false, nil
+	} else if err != nil {
+		return v1.Hash{}, false, err
+	}
+	return desc.Digest, true, nil
+}
+
+func (b *registryBackend) List(ctx context.Context) ([]string, error) {
+	repo, err := b.o.repository()
+	if err != nil {
+		return nil, err
+	}
+	tags, err := remote.List(repo, b.o.remoteOptions(remote.WithContext(ctx))...)
+	if isNotFound(err) {
+		return []string{}, nil
+	}
+	return tags, err
+}
+
+// Delete deletes the manifest by digest since registries like registry:3 refuse deleting tags,
+// then the tag if it is still there.
+func (b *registryBackend) Delete(ctx context.Context, tag string) error {
+	ref, err := b.o.reference(tag)
+	if err != nil {
+		return err
+	}
+	digest, ok, err := b.Exists(ctx, tag)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w, tag \"%s\"", ErrNotFound, tag)
+	}
+	remoteOpts := b.o.remoteOptions(remote.WithContext(ctx))
+	// the manifest is gone already if another tag on it was deleted before
+	if err := remote.Delete(ref.Context().Digest(digest.String()), remoteOpts...); err != nil && !isNotFound(err) {
+		return err
+	}
+	if _, ok, _ := b.Exists(ctx, tag); ok {
+		return remote.Delete(ref, remoteOpts...)
+	}
+	return nil
+}
+
+func (b *registryBackend) Reference(tag string) string {
+	ref, err := b.o.reference(tag)
+	if err != nil {
+		return tag
+	}
+	return ref.String()
+}
+
+func isNotFound(err error) bool {
+	if errors.Is(err, ErrNotFound) {
+		return true
+	}
+	var terr *transport.Error
+	if errors.As(err, &terr) {
+		return terr.StatusCode == http.StatusNotFound
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package api
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/ssuf1998dev/container-registry-as-cache/internal/registry"
+	"github.com/ssuf1998dev/container-registry-as-cache/internal/utils"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestRegistry starts an in-process registry, requires testuser:testpassword if auth is enabled.
+func newTestRegistry(t *testing.T, auth bool) string {
+	opts := registry.Options{}
+	if auth {
+		opts.Htpasswd = "../testdata/htpasswd"
+	}
+	handler, err := registry.New(opts)
+	require.NoError(t, err)
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return fmt.Sprintf("%s/%s", strings.TrimPrefix(server.URL, "http://"), utils.Crac)
+}
+
+// testRegistryRepo returns the repository on CRAC_TEST_REGISTRY, or on an in-process registry
+// with the same htpasswd if it is not set.
+func testRegistryRepo(t *testing.T) string {
+	if reg := os.Getenv("CRAC_TEST_REGISTRY"); len(reg) != 0 {
+		return fmt.Sprintf("%s/%s", reg, utils.Crac)
+	}
+	return newTestRegistry(t, true)
+}
+
+func writeDockerConfig(t *testing.T, content string) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "config.json"), []byte(content), 0600))
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("DOCKER_CONFIG", dir)
+}
+
+func TestRemoteOptions_DockerConfigAuths(t *testing.T) {
+	repo := newTestRegistry(t, true)
+	host := strings.Split(repo, "/")[0]
+	writeDockerConfig(t, fmt.Sprintf(
+		`{"auths":{"%s":{"auth":"%s"}}}`,
+		host, base64.StdEncoding.EncodeToString([]byte("testuser:testpassword")),
+	))
+
+	_, _, err := push(&options{
+		context:   t.Context(),
+		repo:      repo,
+		forceHttp: true,
+		depFiles:  map[string]string{"../testdata/foo": "../testdata/foo"},
+		files:     map[string]string{"../testdata/foo": "../testdata/foo"},
+		forcePush: true,
+	})
+	require.NoError(t, err)
+
+	// explicit credentials win over docker config
+	_, _, err = push(&options{
+		context:   t.Context(),
+		repo:      repo,
+		username:  "testuser",
+		password:  "wrongpassword",
+		forceHttp: true,
+		depFiles:  map[string]string{"../testdata/foo": "../testdata/foo"},
+		files:     map[string]string{"../testdata/foo": "../testdata/foo"},
+		forcePush: true,
+	})
+	require.Error(t, err)
+}
+
+func TestRemoteOptions_DockerConfigCredHelper(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	repo := newTestRegistry(t, true)
+	host := strings.Split(repo, "/")[0]
+	writeDockerConfig(t, fmt.Sprintf(`{"credHelpers":{"%s":"crac-test"}}`, host))
+	helperDir, _ := filepath.Abs("../testdata/credhelper")
+	t.Setenv("PATH", fmt.Sprintf("%s%c%s", helperDir, os.PathListSeparator, os.Getenv("PATH")))
+
+	_, _, err := push(&options{
+		context:   t.Context(),
+		repo:      repo,
+		forceHttp: true,
+		depFiles:  map[string]string{"../testdata/foo": "../testdata/foo"},
+		files:     map[string]string{"../testdata/foo": "../testdata/foo"},
+		forcePush: true,
+	})
+	require.NoError(t, err)
+
+	_, _, err = pull(&options{
+		context:     t.Context(),
+		repo:        repo,
+		forceHttp:   true,
+		depFiles:    map[string]string{"../testdata/foo": "../testdata/foo"},
+		outputBytes: true,
+	})
+	require.NoError(t, err)
+}
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrCacheMiss is matched by errors.Is when no cache image is found for the tag or any restore key.
+var ErrCacheMiss = errors.New("cache miss")
+
+type Status string
+
+const (
+	// StatusHit means the exact tag is pulled.
+	StatusHit Status = "hit"
+	// StatusPartial means a cache image matched by restore keys is pulled.
+	StatusPartial Status = "partial"
+	// StatusMiss means nothing is pulled.
+	StatusMiss Status = "miss"
+	// StatusPushed means the cache image is written to the registry, stdout or file.
+	StatusPushed Status = "pushed"
+	// StatusSkipped means pushing is skipped since the cache image exists, or its cache layer
+	// is unchanged with WithSkipUnchanged.
+	StatusSkipped Status = "skipped"
+)
+
+type Timing struct {
+	// Resolve is spent on computing the tag and looking it up.
+	Resolve time.Duration `json:"resolve"`
+	// Archive is spent on reading files for the layer digest when pushing.
+	Archive time.Duration `json:"archive"`
+	// Transfer is spent on uploading when pushing, or downloading and uncompressing when pulling,
+	// since they are streamed together.
+	Transfer time.Duration `json:"transfer"`
+	Total    time.Duration `json:"total"`
+}
+
+type Result struct {
+	// Status is empty if pushing or pulling fails for reasons other than a miss.
+	Status    Status `json:"status"`
+	Tag       string `json:"tag"`
+	Reference string `json:"reference"`
+	Digest    string `json:"digest"`
+
+	// CompressedSize is the size of cache layer(s) in the registry.
+	CompressedSize int64 `json:"compressedSize"`
+	// UncompressedSize is the size of cache layer(s) as tar.
+	UncompressedSize int64 `json:"uncompressedSize"`
+	// Files is the count of regular files pulled, or entries pushed.
+	Files int `json:"files"`
+	// SavedSize is the compressed size of layers not uploaded when pushing to a registry, since
+	// they are in the repository or mounted from another one.
+	SavedSize int64 `json:"savedSize"`
+
+	Timing Timing `json:"timing"`
+}
+
+// Hit reports whether anything is pulled, exactly or by restore keys.
+func (r *Result) Hit() bool {
+	return r.Status == StatusHit || r.Status == StatusPartial
+}
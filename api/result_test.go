@@ -0,0 +1,48 @@
+package api
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResult(t *testing.T) {
+	repo := newTestRegistry(t, false)
+	foo, _ := filepath.Abs("../testdata/foo")
+	common := []Option{
+		WithContext(t.Context()),
+		WithRepository(repo),
+		WithForceHttp(true),
+		WithDepFiles(map[string]string{"../testdata/foo": foo}),
+	}
+
+	pushed, err := PushWithResult(append(common, WithFiles(map[string]string{"foo": foo}), WithForcePush(false))...)
+	require.NoError(t, err)
+	assert.Equal(t, StatusPushed, pushed.Status)
+	assert.Equal(t, "bd142ccf", pushed.Tag)
+	assert.Equal(t, 1, pushed.Files)
+	assert.Greater(t, pushed.CompressedSize, int64(0))
+	assert.Greater(t, pushed.UncompressedSize, int64(0))
+	assert.NotEmpty(t, pushed.Digest)
+
+	skipped, err := PushWithResult(append(common, WithFiles(map[string]string{"foo": foo}), WithForcePush(false))...)
+	require.NoError(t, err)
+	assert.Equal(t, StatusSkipped, skipped.Status)
+	assert.Equal(t, pushed.Digest, skipped.Digest)
+
+	hit, err := PullWithResult(append(common, WithWorkdir(t.TempDir()))...)
+	require.NoError(t, err)
+	assert.Equal(t, StatusHit, hit.Status)
+	assert.True(t, hit.Hit())
+	assert.Equal(t, pushed.Digest, hit.Digest)
+	assert.Equal(t, 1, hit.Files)
+	assert.Equal(t, pushed.UncompressedSize, hit.UncompressedSize)
+
+	miss, err := PullWithResult(append(common, WithKeys([]string{"changed"}), WithWorkdir(t.TempDir()))...)
+	require.ErrorIs(t, err, ErrCacheMiss)
+	assert.Equal(t, StatusMiss, miss.Status)
+	assert.False(t, miss.Hit())
+	assert.NotEmpty(t, miss.Tag)
+}
@@ -0,0 +1,41 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+)
+
+// Run computes the hash once, restores the cache, then calls command. If the exact tag was not hit
+// and command succeeds, the cache is pushed with the same hash, so the same tag.
+//
+// Options are applied again before pushing, so files and profiles are scanned after command
+// creates them. pushed is nil if pushing is not needed.
+func Run(command func(ctx context.Context) error, opts ...Option) (pulled *Result, pushed *Result, err error) {
+	o := newOptions(opts...)
+	hash, _, err := o.computeHash()
+	if err != nil {
+		return nil, nil, err
+	}
+	o.hash = hash
+
+	pulled, _, err = pull(o)
+	if err != nil && !errors.Is(err, ErrCacheMiss) {
+		return pulled, nil, err
+	}
+	if err != nil {
+		slog.Warn(err.Error())
+	}
+
+	slog.Info("running command...", "status", pulled.Status)
+	if err := command(o.context); err != nil {
+		return pulled, nil, err
+	}
+	if pulled.Status == StatusHit {
+		slog.Info("cache hit exactly, skip pushing", "tag", pulled.Tag)
+		return pulled, nil, nil
+	}
+
+	pushed, _, err = push(newOptions(append(opts, withHash(hash))...))
+	return pulled, pushed, err
+}
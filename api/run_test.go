@@ -0,0 +1,63 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ssuf1998dev/container-registry-as-cache/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	repo := newTestRegistry(t, false)
+	workdir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(workdir, "lock"), []byte("foo"), 0644))
+	cacheFiles := filepath.Join(workdir, "cache", "**")
+
+	runs := 0
+	install := func(ctx context.Context) error {
+		runs++
+		if err := os.MkdirAll(filepath.Join(workdir, "cache"), 0755); err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(workdir, "cache", "a"), []byte("a"), 0644)
+	}
+	opts := []Option{
+		WithContext(t.Context()),
+		WithRepository(repo),
+		WithForceHttp(true),
+		WithWorkdir(workdir),
+		WithDepFiles(map[string]string{"lock": filepath.Join(workdir, "lock")}),
+		WithFilePatterns([]string{cacheFiles}),
+	}
+
+	pulled, pushed, err := Run(install, opts...)
+	require.NoError(t, err)
+	assert.Equal(t, StatusMiss, pulled.Status)
+	require.NotNil(t, pushed)
+	assert.Equal(t, StatusPushed, pushed.Status)
+	assert.Equal(t, pulled.Tag, pushed.Tag)
+	assert.Equal(t, 1, runs)
+	// the hash is recorded, so pulling compares it rather than trusting the tag
+	inspection, err := Inspect(opts...)
+	require.NoError(t, err)
+	hash, _, err := newOptions(opts...).computeHash()
+	require.NoError(t, err)
+	assert.Equal(t, hash, inspection.Meta["hash"])
+	assert.Equal(t, utils.HashSchemeV1, inspection.Meta["hashScheme"])
+
+	pulled, pushed, err = Run(install, opts...)
+	require.NoError(t, err)
+	assert.Equal(t, StatusHit, pulled.Status)
+	assert.Nil(t, pushed)
+	assert.Equal(t, 2, runs)
+
+	failed := errors.New("failed")
+	_, pushed, err = Run(func(ctx context.Context) error { return failed }, append(opts, WithKeys([]string{"changed"}))...)
+	require.ErrorIs(t, err, failed)
+	assert.Nil(t, pushed)
+}
@@ -0,0 +1,143 @@
+package api
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/ssuf1998dev/container-registry-as-cache/internal/utils"
+)
+
+// ComputeTag returns the tag pushing or pulling with the same options would use.
+func ComputeTag(opts ...Option) (string, error) {
+	tag, _, err := newOptions(opts...).computeTag()
+	return tag, err
+}
+
+func (o *options) computeTag() (tag string, keys []string, err error) {
+	if len(o.tag) != 0 {
+		return o.tag, nil, nil
+	}
+	hash, keys, err := o.computeHash()
+	if err != nil {
+		return "", nil, err
+	}
+	return o.joinTag(hash), keys, nil
+}
+
+// joinTag makes the tag of hash with the tag prefix, the hash is truncated to the tag length.
+func (o *options) joinTag(hash string) string {
+	if len(hash) == 0 {
+		return utils.JoinTag(o.tagPrefix, name.DefaultTag)
+	}
+	hash = hash[0:o.tagLengthOrDefault()]
+	if scheme := o.hashSchemeOrDefault(); scheme != utils.HashSchemeV1 {
+		hash = scheme + hash
+	}
+	return utils.JoinTag(o.tagPrefix, hash)
+}
+
+func (o *options) hashSchemeOrDefault() string {
+	if len(o.hashScheme) == 0 {
+		return utils.DefaultHashScheme
+	}
+	return o.hashScheme
+}
+
+func (o *options) tagLengthOrDefault() int {
+	if o.tagLength == 0 {
+		return utils.DefaultTagLength
+	}
+	return o.tagLength
+}
+
+// computeHash returns the untruncated hash of dep files and keys, the platform is one of keys.
+func (o *options) computeHash() (hash string, keys []string, err error) {
+	if length := o.tagLengthOrDefault(); length < 4 || length > 64 {
+		return "", nil, fmt.Errorf("tag length \"%d\" is invalid, it should be from 4 to 64", length)
+	}
+	keys = append(keys, o.keys...)
+	if len(o.platform) > 0 {
+		keys = append(keys, o.platform)
+	}
+	if len(o.hash) != 0 {
+		return o.hash, keys, nil
+	}
+	hash, err = utils.ComputeHash(o.hashSchemeOrDefault(), o.depFiles, keys, o.workdir)
+	return hash, keys, err
+}
+
+// findRestoreTag returns the newest tag matching the first restore key that has any match.
+func (o *options) findRestoreTag(backend Backend) (string, error) {
+	return o.findNewestTag(backend, o.restoreKeys)
+}
+
+// findNewestTag returns the newest tag starting with the first prefix that has any match.
+func (o *options) findNewestTag(backend Backend, prefixes []string) (string, error) {
+	if len(prefixes) == 0 {
+		return "", nil
+	}
+	tags, err := backend.List(o.context)
+	if err != nil {
+		return "", err
+	}
+
+	for _, prefix := range prefixes {
+		prefix = utils.NormalizeTagPrefix(prefix)
+		if len(prefix) == 0 {
+			continue
+		}
+		var newestTag string
+		var newest time.Time
+		for _, tag := range tags {
+			if !strings.HasPrefix(tag, prefix) {
+				continue
+			}
+			if utils.TagScheme(tag) != o.hashSchemeOrDefault() {
+				slog.Debug("tag candidate of another hash scheme", "tag", tag)
+				continue
+			}
+			img, err := backend.Get(o.context, tag)
+			if err != nil {
+				slog.Debug("tag candidate unavailable", "tag", tag, "err", err)
+				continue
+			}
+			cf, err := img.ConfigFile()
+			if err != nil {
+				continue
+			}
+			if len(newestTag) == 0 || cf.Created.Time.After(newest) {
+				newestTag = tag
+				newest = cf.Created.Time
+			}
+		}
+		if len(newestTag) != 0 {
+			slog.Info("tag prefix matched", "prefix", prefix, "tag", newestTag)
+			return newestTag, nil
+		}
+	}
+	return "", nil
+}
+
+// verifyHash compares the hash recorded in meta with the computed one, a mismatch means
+// the truncated hashes in tags collide, or the cache image is of another hash scheme.
+// Tags set by WithTag and meta without the hash are not compared.
+func (o *options) verifyHash(meta *utils.CracMeta) error {
+	if len(o.tag) != 0 || len(meta.Hash) == 0 {
+		return nil
+	}
+	scheme := meta.HashSchemeOrDefault()
+	if scheme != o.hashSchemeOrDefault() {
+		return fmt.Errorf("%w, hash scheme \"%s\" mismatches \"%s\" of the cache image", ErrCacheMiss, o.hashSchemeOrDefault(), scheme)
+	}
+	hash, _, err := o.computeHash()
+	if err != nil {
+		return err
+	}
+	if hash != meta.Hash {
+		return fmt.Errorf("%w, hash \"%s\" mismatches \"%s\" of the cache image, tags collide, try a longer tag length", ErrCacheMiss, hash, meta.Hash)
+	}
+	return nil
+}
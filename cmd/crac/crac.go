@@ -1,19 +1,118 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"text/template"
 
 	"github.com/Masterminds/sprig/v3"
+	"github.com/dustin/go-humanize"
+	"github.com/ssuf1998dev/container-registry-as-cache/api"
+	"github.com/ssuf1998dev/container-registry-as-cache/internal/blobcache"
 	cracprofile "github.com/ssuf1998dev/container-registry-as-cache/internal/profile"
 	"github.com/ssuf1998dev/container-registry-as-cache/internal/utils"
 	"github.com/urfave/cli/v3"
 )
 
+// exit codes of crac, exitSuccess is a hit, or a miss without "--fail-on-miss", which tells a miss
+// by exitMiss, the status of "--result-json" tells them apart either way
+const (
+	exitSuccess = 0
+	exitError   = 1
+	exitMiss    = 2
+)
+
+// logOutput is where logs are written, commands printing json move it to stderr so stdout is
+// only json.
+var logOutput io.Writer = os.Stdout
+
+type logWriter struct{}
+
+func (logWriter) Write(p []byte) (int, error) {
+	return logOutput.Write(p)
+}
+
+type resultJSON struct {
+	*api.Result
+	Hit   bool   `json:"hit"`
+	Error string `json:"error,omitempty"`
+}
+
+// writeResultJSON writes the result for later steps, nothing is written if file is empty.
+func writeResultJSON(file string, result *api.Result, err error) error {
+	if len(file) == 0 {
+		return nil
+	}
+	if result == nil {
+		result = &api.Result{}
+	}
+	out := resultJSON{Result: result, Hit: result.Hit()}
+	if err != nil {
+		out.Error = err.Error()
+	}
+	b, merr := json.MarshalIndent(out, "", "  ")
+	if merr != nil {
+		return merr
+	}
+	return os.WriteFile(file, b, 0644)
+}
+
+// readProfile reads "profile", "profile-file" and "profile-stdin" flags,
+// returns the profile and its type for api.WithProfile.
+func readProfile(cmd *cli.Command) (profile string, profileType string, err error) {
+	profile = cmd.String("profile")
+	if cmd.Bool("profile-stdin") {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			profile += fmt.Sprintf("%s\n", scanner.Text())
+		}
+		return profile, "content", scanner.Err()
+	}
+	if profileFile := cmd.String("profile-file"); len(profileFile) != 0 {
+		return profileFile, "file", nil
+	}
+	return profile, "", nil
+}
+
+// parseMaxSize parses human readable size, "-1" means no limit.
+func parseMaxSize(s string) (int64, error) {
+	if s == "-1" {
+		return -1, nil
+	}
+	size, err := humanize.ParseBytes(s)
+	if err != nil {
+		return 0, fmt.Errorf("max size \"%s\" is invalid", s)
+	}
+	return int64(size), nil
+}
+
+func defaultBlobCacheDir() string {
+	dir, err := blobcache.DefaultDir()
+	if err != nil {
+		return ""
+	}
+	return dir
+}
+
+// blobCacheOption reads "blob-cache", "blob-cache-size" and "no-blob-cache" flags.
+func blobCacheOption(cmd *cli.Command) (api.Option, error) {
+	if cmd.Bool("no-blob-cache") {
+		return api.WithBlobCache("", 0), nil
+	}
+	maxSize, err := parseMaxSize(cmd.String("blob-cache-size"))
+	if err != nil {
+		return nil, err
+	}
+	return api.WithBlobCache(cmd.String("blob-cache"), maxSize), nil
+}
+
 func stringSliceFlagRender(original []string, workdir string) []string {
 	tpl := template.New("").Funcs(cracprofile.TplFuncs(workdir)).Funcs(sprig.FuncMap())
 
@@ -76,7 +175,7 @@ func main() {
 				if err != nil {
 					return ctx, err
 				}
-				slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, nil)))
+				slog.SetDefault(slog.New(slog.NewTextHandler(logWriter{}, nil)))
 				slog.SetLogLoggerLevel(logLevel)
 			}
 			return ctx, nil
@@ -84,11 +183,21 @@ func main() {
 		Commands: []*cli.Command{
 			&push,
 			&pull,
+			&run,
+			&ls,
+			&prune,
+			&inspect,
+			&explain,
+			&serve,
 		},
 	}
 
 	if err := cmd.Run(context.Background(), os.Args); err != nil {
 		slog.Error(err.Error())
-		os.Exit(1)
+		if errors.Is(err, api.ErrCacheMiss) {
+			os.Exit(exitMiss)
+		}
+		os.Exit(exitError)
 	}
+	os.Exit(exitSuccess)
 }
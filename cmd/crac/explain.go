@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/ssuf1998dev/container-registry-as-cache/api"
+	"github.com/ssuf1998dev/container-registry-as-cache/internal/utils"
+	"github.com/urfave/cli/v3"
+)
+
+var explain = cli.Command{
+	Name:  "explain",
+	Usage: "tell which keys or dep files differ from a cache image, to diagnose a miss",
+	Description: "keys, dep files and the platform are compared with the meta of the cache image named by \"--tag\", " +
+		"or the newest one starting with the tag prefix",
+	ArgsUsage: "[repository]",
+	Suggest:   false,
+	Arguments: []cli.Argument{
+		&cli.StringArg{Name: "repo"},
+	},
+	Flags: slices.Concat(
+		pickFlags(pull.Flags,
+			"backend", "key", "dep", "tag", "prefix", "tag-length", "hash-scheme", "workdir", "platform", "unknown-platform",
+		),
+		pickFlags(ls.Flags, "format"),
+		pickFlags(pull.Flags,
+			"profile", "profile-file", "profile-stdin",
+			"username", "password", "force-http", "insecure",
+		),
+	),
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		slog.Debug("explaining...")
+
+		workdir := cmd.String("workdir")
+
+		repo := cmd.StringArg("repo")
+		if len(repo) == 0 {
+			return fmt.Errorf("argument repository is required")
+		}
+		format := cmd.String("format")
+		if format != "table" && format != "json" {
+			return fmt.Errorf("format \"%s\" is invalid", format)
+		}
+		if format == "json" {
+			logOutput = os.Stderr
+		}
+
+		keys := stringSliceFlagRender(cmd.StringSlice("key"), workdir)
+		deps := utils.ScanFiles(stringSliceFlagRender(cmd.StringSlice("dep"), workdir))
+		profile, profileType, err := readProfile(cmd)
+		if err != nil {
+			return err
+		}
+
+		platform := cmd.String("platform")
+		if cmd.Bool("unknown-platform") {
+			platform = "unknown/unknown"
+		}
+
+		explanation, err := api.Explain(
+			api.WithContext(ctx),
+			api.WithRepository(repo),
+			api.WithBackendType(cmd.String("backend")),
+			api.WithUsername(cmd.String("username")),
+			api.WithPassword(cmd.String("password")),
+			api.WithForceHttp(cmd.Bool("force-http")),
+			api.WithInsecure(cmd.Bool("insecure")),
+			api.WithKeys(keys),
+			api.WithDepFiles(deps),
+			api.WithTag(cmd.String("tag")),
+			api.WithTagPrefix(stringSliceFlagRender([]string{cmd.String("prefix")}, workdir)[0]),
+			api.WithTagLength(cmd.Int("tag-length")),
+			api.WithHashScheme(cmd.String("hash-scheme")),
+			api.WithWorkdir(workdir),
+			api.WithPlatform(platform),
+			api.WithProfile(profile, profileType),
+		)
+		if err != nil {
+			return err
+		}
+
+		if format == "json" {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(explanation)
+		}
+
+		reference := explanation.Reference
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "Local tag:\t%s\n", explanation.Tag)
+		fmt.Fprintf(w, "Reference:\t%s (%s, %s)\n", reference.Tag, reference.Created.Local().Format(time.DateTime), humanize.Time(reference.Created))
+		fmt.Fprintf(w, "Match:\t%t\n", explanation.Match)
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		if explanation.Incomplete {
+			if slices.ContainsFunc(explanation.Diffs, func(d *api.InputDiff) bool { return d.Kind == api.DiffKindPlatform }) {
+				fmt.Println("\nthe reference is pushed by an older version without dep files recorded, dep files are not compared")
+			} else {
+				fmt.Println("\nthe reference is pushed by an older version without inputs recorded, only the hash scheme and the prefix are compared")
+			}
+		}
+
+		changed := explanation.Changed()
+		if len(changed) == 0 {
+			fmt.Printf("\nno difference, %d input(s) are the same\n", len(explanation.Diffs))
+			return nil
+		}
+		fmt.Println()
+		w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "KIND\tNAME\tSTATUS\tLOCAL\tREFERENCE")
+		for _, d := range changed {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", d.Kind, d.Name, d.Status, short(d.Local), short(d.Reference))
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		fmt.Printf("\n%d input(s) differ, %d are the same\n", len(changed), len(explanation.Diffs)-len(changed))
+		return nil
+	},
+}
+
+// short truncates sha256 hex to 12 characters.
+func short(s string) string {
+	if len(s) == 64 {
+		return s[:12]
+	}
+	return s
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/goccy/go-yaml"
+	"github.com/ssuf1998dev/container-registry-as-cache/api"
+	"github.com/ssuf1998dev/container-registry-as-cache/internal/utils"
+	"github.com/urfave/cli/v3"
+)
+
+var inspect = cli.Command{
+	Name:        "inspect",
+	Usage:       "show metadata, history and layers of a cache image without extracting it",
+	Description: "the tag is resolved the same way as pull, by \"--tag\", or keys, dep files and restore keys",
+	ArgsUsage:   "[repository]",
+	Suggest:     false,
+	Arguments: []cli.Argument{
+		&cli.StringArg{Name: "repo"},
+	},
+	Flags: slices.Concat(
+		pickFlags(pull.Flags,
+			"backend", "key", "dep", "tag", "prefix", "tag-length", "hash-scheme", "restore-key", "workdir", "platform", "unknown-platform",
+		),
+		[]cli.Flag{
+			&cli.BoolFlag{
+				Name: "files", Category: "BASIC",
+				Usage: "list files in the cache layer with sizes, the layer is downloaded but not extracted",
+			},
+		},
+		pickFlags(ls.Flags, "format"),
+		pickFlags(pull.Flags,
+			"profile", "profile-file", "profile-stdin",
+			"username", "password", "force-http", "insecure",
+		),
+	),
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		slog.Debug("inspecting...")
+
+		workdir := cmd.String("workdir")
+
+		repo := cmd.StringArg("repo")
+		if len(repo) == 0 {
+			return fmt.Errorf("argument repository is required")
+		}
+		format := cmd.String("format")
+		if format != "table" && format != "json" {
+			return fmt.Errorf("format \"%s\" is invalid", format)
+		}
+		if format == "json" {
+			logOutput = os.Stderr
+		}
+
+		keys := stringSliceFlagRender(cmd.StringSlice("key"), workdir)
+		deps := utils.ScanFiles(stringSliceFlagRender(cmd.StringSlice("dep"), workdir))
+		profile, profileType, err := readProfile(cmd)
+		if err != nil {
+			return err
+		}
+
+		platform := cmd.String("platform")
+		if cmd.Bool("unknown-platform") {
+			platform = "unknown/unknown"
+		}
+
+		inspection, err := api.Inspect(
+			api.WithContext(ctx),
+			api.WithRepository(repo),
+			api.WithBackendType(cmd.String("backend")),
+			api.WithUsername(cmd.String("username")),
+			api.WithPassword(cmd.String("password")),
+			api.WithForceHttp(cmd.Bool("force-http")),
+			api.WithInsecure(cmd.Bool("insecure")),
+			api.WithKeys(keys),
+			api.WithDepFiles(deps),
+			api.WithTag(cmd.String("tag")),
+			api.WithTagPrefix(stringSliceFlagRender([]string{cmd.String("prefix")}, workdir)[0]),
+			api.WithTagLength(cmd.Int("tag-length")),
+			api.WithHashScheme(cmd.String("hash-scheme")),
+			api.WithRestoreKeys(stringSliceFlagRender(cmd.StringSlice("restore-key"), workdir)),
+			api.WithWorkdir(workdir),
+			api.WithPlatform(platform),
+			api.WithProfile(profile, profileType),
+			api.WithListFiles(cmd.Bool("files")),
+		)
+		if err != nil {
+			return err
+		}
+
+		if format == "json" {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(inspection)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "Tag:\t%s\n", inspection.Tag)
+		fmt.Fprintf(w, "Exact:\t%t\n", inspection.Exact)
+		fmt.Fprintf(w, "Reference:\t%s\n", inspection.Reference)
+		fmt.Fprintf(w, "Digest:\t%s\n", inspection.Digest)
+		fmt.Fprintf(w, "Created:\t%s (%s)\n", inspection.Created.Local().Format(time.DateTime), humanize.Time(inspection.Created))
+		fmt.Fprintf(w, "Size:\t%s\n", humanize.Bytes(uint64(inspection.Size)))
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		meta, err := yaml.Marshal(inspection.Meta)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("\nMeta:\n%s", indent(string(meta)))
+
+		fmt.Println("\nHistory:")
+		w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, h := range inspection.History {
+			fmt.Fprintf(w, "  %s\t%s\n", h.CreatedBy, h.Created.Local().Format(time.DateTime))
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		fmt.Println("\nLayers:")
+		w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, l := range inspection.Layers {
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%s\n", l.CreatedBy, l.Digest, humanize.Bytes(uint64(l.Size)), l.MediaType)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		if inspection.Files == nil {
+			return nil
+		}
+		fmt.Println("\nFiles:")
+		w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		var total int64
+		for _, f := range inspection.Files {
+			name := f.Name
+			if len(f.Linkname) != 0 {
+				name = fmt.Sprintf("%s -> %s", name, f.Linkname)
+			}
+			fmt.Fprintf(w, "  %s\t%s\t%s\n", f.Mode, humanize.Bytes(uint64(f.Size)), name)
+			total += f.Size
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		fmt.Printf("\n%d entries, %s\n", len(inspection.Files), humanize.Bytes(uint64(total)))
+		return nil
+	},
+}
+
+func indent(s string) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = "  " + line
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/ssuf1998dev/container-registry-as-cache/api"
+	"github.com/urfave/cli/v3"
+)
+
+var ls = cli.Command{
+	Name:      "ls",
+	Usage:     "list cache images of a repository with their metadata",
+	ArgsUsage: "[repository]",
+	Suggest:   false,
+	Arguments: []cli.Argument{
+		&cli.StringArg{Name: "repo"},
+	},
+	Flags: slices.Concat(
+		pickFlags(pull.Flags, "backend"),
+		[]cli.Flag{
+			&cli.StringFlag{
+				Name: "prefix", Category: "BASIC",
+				Usage: "only list tags starting with the prefix, aka key scope",
+			},
+			&cli.StringFlag{
+				Name: "platform", Aliases: []string{"P"}, Category: "BASIC",
+				Usage: "only list caches of the platform",
+			},
+			&cli.StringFlag{
+				Name: "format", Value: "table", Category: "BASIC",
+				Usage: "output format, could be \"table\" or \"json\"",
+			},
+			&cli.StringFlag{
+				Name: "sort", Value: "created", Category: "BASIC",
+				Usage: "sort by \"created\", \"size\" or \"tag\", newest, largest or alphabetical first",
+			},
+			&cli.BoolFlag{
+				Name: "reverse", Aliases: []string{"r"}, Category: "BASIC",
+				Usage: "reverse the order",
+			},
+			&cli.IntFlag{
+				Name: "limit", Aliases: []string{"n"}, Category: "BASIC",
+				Usage: "list at most n caches, 0 means no limit",
+			},
+		},
+		pickFlags(pull.Flags, "username", "password", "force-http", "insecure"),
+	),
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		slog.Debug("listing...")
+
+		repo := cmd.StringArg("repo")
+		if len(repo) == 0 {
+			return fmt.Errorf("argument repository is required")
+		}
+
+		var compare func(a, b *api.Entry) int
+		switch s := cmd.String("sort"); s {
+		case "created":
+			compare = func(a, b *api.Entry) int { return b.Created.Compare(a.Created) }
+		case "size":
+			compare = func(a, b *api.Entry) int { return cmp.Compare(b.Size, a.Size) }
+		case "tag":
+			compare = func(a, b *api.Entry) int { return strings.Compare(a.Tag, b.Tag) }
+		default:
+			return fmt.Errorf("sort \"%s\" is invalid", s)
+		}
+		format := cmd.String("format")
+		if format != "table" && format != "json" {
+			return fmt.Errorf("format \"%s\" is invalid", format)
+		}
+		if format == "json" {
+			logOutput = os.Stderr
+		}
+
+		entries, err := api.List(
+			api.WithContext(ctx),
+			api.WithRepository(repo),
+			api.WithBackendType(cmd.String("backend")),
+			api.WithUsername(cmd.String("username")),
+			api.WithPassword(cmd.String("password")),
+			api.WithForceHttp(cmd.Bool("force-http")),
+			api.WithInsecure(cmd.Bool("insecure")),
+			api.WithTagPrefix(cmd.String("prefix")),
+		)
+		if err != nil {
+			return err
+		}
+
+		if platform := cmd.String("platform"); len(platform) != 0 {
+			entries = slices.DeleteFunc(entries, func(e *api.Entry) bool { return e.Platform != platform })
+		}
+		slices.SortStableFunc(entries, compare)
+		if cmd.Bool("reverse") {
+			slices.Reverse(entries)
+		}
+		if limit := cmd.Int("limit"); limit > 0 && len(entries) > limit {
+			entries = entries[:limit]
+		}
+
+		if format == "json" {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(entries)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "TAG\tCREATED\tAGE\tSIZE\tVERSION\tPLATFORM\tKEYS")
+		for _, e := range entries {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				e.Tag,
+				e.Created.Local().Format(time.DateTime),
+				humanize.Time(e.Created),
+				humanize.Bytes(uint64(e.Size)),
+				e.Version,
+				e.Platform,
+				strings.Join(e.Keys, ", "),
+			)
+		}
+		return w.Flush()
+	},
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/ssuf1998dev/container-registry-as-cache/api"
+	"github.com/urfave/cli/v3"
+)
+
+// parseAge parses durations like time.ParseDuration, "d" is accepted as days.
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.ParseFloat(days, 64)
+		if err != nil {
+			return 0, fmt.Errorf("age \"%s\" is invalid", s)
+		}
+		return time.Duration(n * float64(24*time.Hour)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("age \"%s\" is invalid", s)
+	}
+	return d, nil
+}
+
+var prune = cli.Command{
+	Name:  "prune",
+	Usage: "delete cache images by retention policies",
+	Description: "a cache image is deleted if any policy says so, " +
+		"registries may need garbage collecting to free the reclaimed size",
+	ArgsUsage: "[repository]",
+	Suggest:   false,
+	Arguments: []cli.Argument{
+		&cli.StringArg{Name: "repo"},
+	},
+	Flags: slices.Concat(
+		pickFlags(pull.Flags, "backend"),
+		pickFlags(ls.Flags, "prefix"),
+		[]cli.Flag{
+			&cli.StringFlag{
+				Name: "max-age", Category: "POLICY",
+				Usage: "delete cache images older than it, e.g. \"72h\" or \"30d\"",
+			},
+			&cli.IntFlag{
+				Name: "keep", Category: "POLICY",
+				Usage: "keep the newest n cache images of each key scope, aka tag prefix",
+			},
+			&cli.StringFlag{
+				Name: "max-total-size", Category: "POLICY",
+				Usage: "delete the oldest cache images until the total size is under it, e.g. \"20GiB\"",
+			},
+			&cli.BoolFlag{
+				Name: "dry-run", Category: "BASIC",
+				Usage: "print what would be deleted without deleting",
+			},
+		},
+		pickFlags(ls.Flags, "format"),
+		pickFlags(pull.Flags, "username", "password", "force-http", "insecure"),
+	),
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		slog.Debug("pruning...")
+
+		repo := cmd.StringArg("repo")
+		if len(repo) == 0 {
+			return fmt.Errorf("argument repository is required")
+		}
+		format := cmd.String("format")
+		if format != "table" && format != "json" {
+			return fmt.Errorf("format \"%s\" is invalid", format)
+		}
+		if format == "json" {
+			logOutput = os.Stderr
+		}
+
+		var maxAge time.Duration
+		if s := cmd.String("max-age"); len(s) != 0 {
+			var err error
+			if maxAge, err = parseAge(s); err != nil {
+				return err
+			}
+		}
+		var maxTotalSize int64
+		if s := cmd.String("max-total-size"); len(s) != 0 {
+			size, err := humanize.ParseBytes(s)
+			if err != nil {
+				return fmt.Errorf("max total size \"%s\" is invalid", s)
+			}
+			maxTotalSize = int64(size)
+		}
+
+		result, err := api.Prune(
+			api.WithContext(ctx),
+			api.WithRepository(repo),
+			api.WithBackendType(cmd.String("backend")),
+			api.WithUsername(cmd.String("username")),
+			api.WithPassword(cmd.String("password")),
+			api.WithForceHttp(cmd.Bool("force-http")),
+			api.WithInsecure(cmd.Bool("insecure")),
+			api.WithTagPrefix(cmd.String("prefix")),
+			api.WithMaxAge(maxAge),
+			api.WithKeepLatest(cmd.Int("keep")),
+			api.WithMaxTotalSize(maxTotalSize),
+			api.WithDryRun(cmd.Bool("dry-run")),
+		)
+		if result == nil {
+			return err
+		}
+
+		if format == "json" {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if encodeErr := encoder.Encode(result); encodeErr != nil {
+				return encodeErr
+			}
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "DELETED\tCREATED\tAGE\tSIZE")
+		for _, e := range result.Deleted {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n",
+				e.Tag,
+				e.Created.Local().Format(time.DateTime),
+				humanize.Time(e.Created),
+				humanize.Bytes(uint64(e.Size)),
+			)
+		}
+		if werr := w.Flush(); werr != nil {
+			return werr
+		}
+		verb := "deleted"
+		if result.DryRun {
+			verb = "would be deleted"
+		}
+		fmt.Printf("%d cache image(s) %s, %d kept, %s reclaimed\n",
+			len(result.Deleted), verb, len(result.Kept), humanize.Bytes(uint64(result.ReclaimedSize)))
+		return err
+	},
+}
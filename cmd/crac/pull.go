@@ -1,28 +1,38 @@
 package main
 
 import (
-	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io/fs"
 	"log/slog"
-	"os"
 	"runtime"
 
+	"github.com/dustin/go-humanize"
 	"github.com/ssuf1998dev/container-registry-as-cache/api"
+	"github.com/ssuf1998dev/container-registry-as-cache/internal/blobcache"
+	"github.com/ssuf1998dev/container-registry-as-cache/internal/tarhelper"
 	"github.com/ssuf1998dev/container-registry-as-cache/internal/utils"
 	"github.com/urfave/cli/v3"
 )
 
 var pull = cli.Command{
-	Name:      "pull",
-	Usage:     "pull cache image then uncompress it",
+	Name:  "pull",
+	Usage: "pull cache image then uncompress it",
+	Description: "exit codes:\n" +
+		"   0  cache hit, exact or by restore keys\n" +
+		"   1  error\n" +
+		"   2  cache miss with \"--fail-on-miss\", otherwise a miss exits with 0, see \"--result-json\"",
 	ArgsUsage: "[repository]",
 	Suggest:   false,
 	Arguments: []cli.Argument{
 		&cli.StringArg{Name: "repo"},
 	},
 	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name: "backend", Aliases: []string{"b"}, Category: "BASIC",
+			Usage: "where cache images are stored, could be \"registry\", \"dir\" or \"oci\", or picked by a scheme of repository, \"docker://\", \"dir:\" or \"oci:\"",
+		},
 		&cli.StringSliceFlag{
 			Name: "key", Aliases: []string{"k"}, Category: "BASIC",
 			Usage: "key(s) for computing cache image tag",
@@ -35,6 +45,23 @@ var pull = cli.Command{
 			Name: "tag", Aliases: []string{"t"}, Category: "BASIC",
 			Usage: "specific a tag to pull",
 		},
+		&cli.StringFlag{
+			Name: "prefix", Category: "BASIC",
+			Usage: "readable prefix of cache image tag, the tag will be \"<prefix>-<hash>\"",
+		},
+		&cli.IntFlag{
+			Name: "tag-length", Category: "BASIC", Value: utils.DefaultTagLength,
+			Usage: "hex characters of the hash kept in the tag, from 4 to 64, longer ones are less likely to collide",
+		},
+		&cli.StringFlag{
+			Name: "hash-scheme", Category: "BASIC", Value: utils.DefaultHashScheme,
+			Usage: "how dep files and keys are hashed, \"v1\" hashes contents, \"v2\" hashes relative paths of dep files as well, " +
+				"cache images of another scheme never match",
+		},
+		&cli.StringSliceFlag{
+			Name: "restore-key", Category: "BASIC",
+			Usage: "tag prefix(es) to try in order if the exact tag is missing, the newest matched one will be pulled",
+		},
 		&cli.StringFlag{
 			Name: "workdir", Aliases: []string{"w"}, Category: "BASIC",
 			Usage: "working directory where to uncompress file(s) to",
@@ -44,18 +71,72 @@ var pull = cli.Command{
 			Usage: "platform of cache, it will be a part of keys changing tag",
 		},
 		&cli.Uint32Flag{
-			Name: "perm", Category: "BASIC", Value: 0755, DefaultText: "0755",
-			Usage: "chmod all pulled file",
+			Name: "perm", Category: "BASIC",
+			Usage: "chmod all pulled file, archived modes are kept if not set",
 		},
 		&cli.BoolFlag{
 			Name: "unknown-platform", Category: "BASIC",
 			Usage: "override platform of cache to unknown/unknown",
 		},
+		&cli.BoolFlag{
+			Name: "atomic", Category: "BASIC",
+			Usage: "uncompress into a staging directory then swap entries of the cache into workdir, workdir is untouched on failure",
+		},
 		&cli.BoolFlag{
 			Name: "stdout", Category: "BASIC",
 			Usage: "output to stdout",
 		},
 
+		&cli.StringFlag{
+			Name: "result-json", Category: "BASIC",
+			Usage: "write tag, digest and hit status as json to file",
+		},
+		&cli.BoolFlag{
+			Name: "fail-on-miss", Category: "BASIC",
+			Usage: "exit with code 2 on a miss, otherwise a miss exits with code 0",
+		},
+		&cli.BoolFlag{
+			Name: "no-symlinks", Category: "ARCHIVE",
+			Usage: "skip symlinks",
+		},
+		&cli.BoolFlag{
+			Name: "no-hardlinks", Category: "ARCHIVE",
+			Usage: "extract hard links as separate copies",
+		},
+		&cli.BoolFlag{
+			Name: "no-dirs", Category: "ARCHIVE",
+			Usage: "skip directory entries, empty directories are dropped",
+		},
+		&cli.BoolFlag{
+			Name: "no-mode", Category: "ARCHIVE",
+			Usage: "ignore archived modes",
+		},
+		&cli.BoolFlag{
+			Name: "no-mtime", Category: "ARCHIVE",
+			Usage: "ignore archived modification times",
+		},
+		&cli.IntFlag{
+			Name: "max-entries", Category: "ARCHIVE", Value: tarhelper.DefaultMaxEntries,
+			Usage: "max count of entries to uncompress, negative means no limit",
+		},
+		&cli.StringFlag{
+			Name: "max-size", Category: "ARCHIVE", Value: humanize.IBytes(tarhelper.DefaultMaxSize),
+			Usage: "max total size of files to uncompress, \"-1\" means no limit",
+		},
+
+		&cli.StringFlag{
+			Name: "blob-cache", Category: "CACHE", Value: defaultBlobCacheDir(),
+			Usage: "directory keeping layers pulled from or pushed to a registry, pulling reads a layer from it if it is there",
+		},
+		&cli.StringFlag{
+			Name: "blob-cache-size", Category: "CACHE", Value: humanize.IBytes(uint64(blobcache.DefaultMaxSize)),
+			Usage: "max total size of blob cache, least recently used layers are evicted, \"-1\" means no limit",
+		},
+		&cli.BoolFlag{
+			Name: "no-blob-cache", Category: "CACHE",
+			Usage: "disable blob cache",
+		},
+
 		&cli.StringFlag{
 			Name: "profile", Category: "PROFILE",
 			Usage: "a series of pre-set configurations",
@@ -71,11 +152,11 @@ var pull = cli.Command{
 
 		&cli.StringFlag{
 			Name: "username", Aliases: []string{"u"}, Category: "AUTH",
-			Usage: "username for authenticating to a registry",
+			Usage: "username for authenticating to a registry, credentials in docker config are used if not set",
 		},
 		&cli.StringFlag{
 			Name: "password", Aliases: []string{"p"}, Category: "AUTH",
-			Usage: "password for authenticating to a registry",
+			Usage: "password for authenticating to a registry, credentials in docker config are used if not set",
 		},
 		&cli.BoolFlag{
 			Name: "force-http", Category: "AUTH",
@@ -98,19 +179,14 @@ var pull = cli.Command{
 
 		keys := stringSliceFlagRender(cmd.StringSlice("key"), workdir)
 		deps := utils.ScanFiles(stringSliceFlagRender(cmd.StringSlice("dep"), workdir))
-		profile := cmd.String("profile")
-		profileFile := cmd.String("profile-file")
-		profileStdin := cmd.Bool("profile-stdin")
-		if profileStdin {
-			scanner := bufio.NewScanner(os.Stdin)
-			for scanner.Scan() {
-				profile += fmt.Sprintf("%s\n", scanner.Text())
-			}
-			if err := scanner.Err(); err != nil {
-				return err
-			}
-		} else if len(profileFile) != 0 {
-			profile = profileFile
+		profile, profileType, err := readProfile(cmd)
+		if err != nil {
+			return err
+		}
+
+		maxSize, err := parseMaxSize(cmd.String("max-size"))
+		if err != nil {
+			return err
 		}
 
 		platform := cmd.String("platform")
@@ -118,9 +194,15 @@ var pull = cli.Command{
 			platform = "unknown/unknown"
 		}
 
-		return api.Pull(
+		blobCache, err := blobCacheOption(cmd)
+		if err != nil {
+			return err
+		}
+
+		result, err := api.PullWithResult(
 			api.WithContext(context.Background()),
 			api.WithRepository(repo),
+			api.WithBackendType(cmd.String("backend")),
 			api.WithUsername(cmd.String("username")),
 			api.WithPassword(cmd.String("password")),
 			api.WithForceHttp(cmd.Bool("force-http")),
@@ -128,19 +210,31 @@ var pull = cli.Command{
 			api.WithKeys(keys),
 			api.WithDepFiles(deps),
 			api.WithTag(cmd.String("tag")),
+			api.WithTagPrefix(stringSliceFlagRender([]string{cmd.String("prefix")}, workdir)[0]),
+			api.WithTagLength(cmd.Int("tag-length")),
+			api.WithHashScheme(cmd.String("hash-scheme")),
+			api.WithRestoreKeys(stringSliceFlagRender(cmd.StringSlice("restore-key"), workdir)),
 			api.WithWorkdir(workdir),
 			api.WithPlatform(platform),
+			api.WithNoSymlinks(cmd.Bool("no-symlinks")),
+			api.WithNoHardlinks(cmd.Bool("no-hardlinks")),
+			api.WithNoDirs(cmd.Bool("no-dirs")),
+			api.WithNoModes(cmd.Bool("no-mode")),
+			api.WithNoMtimes(cmd.Bool("no-mtime")),
+			api.WithMaxEntries(cmd.Int("max-entries")),
+			api.WithMaxSize(maxSize),
+			api.WithAtomic(cmd.Bool("atomic")),
 			api.WithFilePerm(fs.FileMode(cmd.Uint32("perm"))),
-			api.WithProfile(profile, func() string {
-				if profileStdin {
-					return "content"
-				}
-				if len(profileFile) != 0 {
-					return "file"
-				}
-				return ""
-			}()),
+			api.WithProfile(profile, profileType),
+			blobCache,
 			api.WithOutputStdout(cmd.Bool("stdout")),
 		)
+		// failing to write the result is an error even if a miss is not
+		werr := writeResultJSON(cmd.String("result-json"), result, err)
+		if errors.Is(err, api.ErrCacheMiss) && !cmd.Bool("fail-on-miss") {
+			slog.Warn(err.Error())
+			err = nil
+		}
+		return errors.Join(err, werr)
 	},
 }
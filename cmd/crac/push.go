@@ -1,14 +1,15 @@
 package main
 
 import (
-	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
-	"os"
 	"runtime"
 
+	"github.com/dustin/go-humanize"
 	"github.com/ssuf1998dev/container-registry-as-cache/api"
+	"github.com/ssuf1998dev/container-registry-as-cache/internal/blobcache"
 	"github.com/ssuf1998dev/container-registry-as-cache/internal/utils"
 	"github.com/urfave/cli/v3"
 )
@@ -22,6 +23,10 @@ var push = cli.Command{
 		&cli.StringArg{Name: "repo"},
 	},
 	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name: "backend", Aliases: []string{"b"}, Category: "BASIC",
+			Usage: "where cache images are stored, could be \"registry\", \"dir\" or \"oci\", or picked by a scheme of repository, \"docker://\", \"dir:\" or \"oci:\"",
+		},
 		&cli.StringSliceFlag{
 			Name: "key", Aliases: []string{"K"}, Category: "BASIC",
 			Usage: "key(s) for computing cache image tag",
@@ -38,6 +43,19 @@ var push = cli.Command{
 			Name: "file", Aliases: []string{"f"}, Category: "BASIC",
 			Usage: "cache file(s) to make image, glob supported",
 		},
+		&cli.StringFlag{
+			Name: "prefix", Category: "BASIC",
+			Usage: "readable prefix of cache image tag, the tag will be \"<prefix>-<hash>\"",
+		},
+		&cli.IntFlag{
+			Name: "tag-length", Category: "BASIC", Value: utils.DefaultTagLength,
+			Usage: "hex characters of the hash kept in the tag, from 4 to 64, longer ones are less likely to collide",
+		},
+		&cli.StringFlag{
+			Name: "hash-scheme", Category: "BASIC", Value: utils.DefaultHashScheme,
+			Usage: "how dep files and keys are hashed, \"v1\" hashes contents, \"v2\" hashes relative paths of dep files as well, " +
+				"cache images of another scheme never match",
+		},
 		&cli.StringFlag{
 			Name: "workdir", Aliases: []string{"w"}, Category: "BASIC",
 			Usage: "working directory where to uncompress file(s) to",
@@ -58,6 +76,79 @@ var push = cli.Command{
 			Name: "force", Category: "BASIC", Value: true,
 			Usage: "force push to remote registry",
 		},
+		&cli.StringSliceFlag{
+			Name: "mount-from", Category: "BASIC",
+			Usage: "repository on the same registry to mount layers from, layers found in it are linked rather than uploaded",
+		},
+		&cli.BoolFlag{
+			Name: "skip-unchanged", Category: "BASIC",
+			Usage: "build the cache layer, then only push if its digest differs from the stored one under the tag, " +
+				"overrides \"--force\", pair with \"--reproducible\"",
+		},
+		&cli.StringFlag{
+			Name: "base", Category: "BASIC",
+			Usage: "tag or tag prefix of a cache image to stack a delta layer of added, changed and deleted files on, " +
+				"the newest one is picked for a prefix, full layers are pushed if none is found",
+		},
+		&cli.IntFlag{
+			Name: "max-depth", Category: "BASIC", Value: utils.DefaultMaxDepth,
+			Usage: "max delta layers stacked by \"--base\", a deeper cache image is compacted into full layers",
+		},
+
+		&cli.StringFlag{
+			Name: "result-json", Category: "BASIC",
+			Usage: "write tag, digest and hit status as json to file",
+		},
+		&cli.BoolFlag{
+			Name: "no-symlinks", Category: "ARCHIVE",
+			Usage: "follow symlinks and archive their targets",
+		},
+		&cli.BoolFlag{
+			Name: "no-hardlinks", Category: "ARCHIVE",
+			Usage: "archive hard linked files as separate copies",
+		},
+		&cli.BoolFlag{
+			Name: "no-dirs", Category: "ARCHIVE",
+			Usage: "do not archive directory entries, empty directories are dropped",
+		},
+		&cli.BoolFlag{
+			Name: "no-mode", Category: "ARCHIVE",
+			Usage: "do not archive file modes",
+		},
+		&cli.BoolFlag{
+			Name: "no-mtime", Category: "ARCHIVE",
+			Usage: "do not archive modification times",
+		},
+		&cli.BoolFlag{
+			Name: "reproducible", Category: "ARCHIVE",
+			Usage: "archive mtimes as $SOURCE_DATE_EPOCH or the Unix epoch, so the same files always make the same layer digest",
+		},
+		&cli.StringFlag{
+			Name: "split", Category: "ARCHIVE", Value: utils.SplitNone,
+			Usage: "partition the cache into layers, \"dir\" makes a layer per directory, \"hash\" makes layers by a hash of directories, " +
+				"so unchanged groups keep their layer digests",
+		},
+		&cli.IntFlag{
+			Name: "split-depth", Category: "ARCHIVE", Value: utils.DefaultSplitDepth,
+			Usage: "leading path components of the directory grouping a file",
+		},
+		&cli.IntFlag{
+			Name: "split-layers", Category: "ARCHIVE", Value: utils.DefaultSplitLayers,
+			Usage: "max layers of \"--split hash\"",
+		},
+
+		&cli.StringFlag{
+			Name: "blob-cache", Category: "CACHE", Value: defaultBlobCacheDir(),
+			Usage: "directory keeping layers pulled from or pushed to a registry, pulling reads a layer from it if it is there",
+		},
+		&cli.StringFlag{
+			Name: "blob-cache-size", Category: "CACHE", Value: humanize.IBytes(uint64(blobcache.DefaultMaxSize)),
+			Usage: "max total size of blob cache, least recently used layers are evicted, \"-1\" means no limit",
+		},
+		&cli.BoolFlag{
+			Name: "no-blob-cache", Category: "CACHE",
+			Usage: "disable blob cache",
+		},
 
 		&cli.StringFlag{
 			Name: "profile", Category: "PROFILE",
@@ -74,11 +165,11 @@ var push = cli.Command{
 
 		&cli.StringFlag{
 			Name: "username", Aliases: []string{"u"}, Category: "AUTH",
-			Usage: "username for authenticating to a registry",
+			Usage: "username for authenticating to a registry, credentials in docker config are used if not set",
 		},
 		&cli.StringFlag{
 			Name: "password", Aliases: []string{"p"}, Category: "AUTH",
-			Usage: "password for authenticating to a registry",
+			Usage: "password for authenticating to a registry, credentials in docker config are used if not set",
 		},
 		&cli.BoolFlag{
 			Name: "force-http", Category: "AUTH",
@@ -101,20 +192,10 @@ var push = cli.Command{
 
 		keys := stringSliceFlagRender(cmd.StringSlice("key"), workdir)
 		deps := utils.ScanFiles(stringSliceFlagRender(cmd.StringSlice("dep"), workdir))
-		files := utils.ScanFiles(stringSliceFlagRender(cmd.StringSlice("file"), workdir))
-		profile := cmd.String("profile")
-		profileFile := cmd.String("profile-file")
-		profileStdin := cmd.Bool("profile-stdin")
-		if profileStdin {
-			scanner := bufio.NewScanner(os.Stdin)
-			for scanner.Scan() {
-				profile += fmt.Sprintf("%s\n", scanner.Text())
-			}
-			if err := scanner.Err(); err != nil {
-				return err
-			}
-		} else if len(profileFile) != 0 {
-			profile = profileFile
+		files := utils.ScanEntries(stringSliceFlagRender(cmd.StringSlice("file"), workdir), cmd.Bool("no-symlinks"))
+		profile, profileType, err := readProfile(cmd)
+		if err != nil {
+			return err
 		}
 
 		output := cmd.String("output")
@@ -124,9 +205,15 @@ var push = cli.Command{
 			platform = "unknown/unknown"
 		}
 
-		return api.Push(
+		blobCache, err := blobCacheOption(cmd)
+		if err != nil {
+			return err
+		}
+
+		result, err := api.PushWithResult(
 			api.WithContext(context.Background()),
 			api.WithRepository(repo),
+			api.WithBackendType(cmd.String("backend")),
 			api.WithUsername(cmd.String("username")),
 			api.WithPassword(cmd.String("password")),
 			api.WithForceHttp(cmd.Bool("force-http")),
@@ -134,21 +221,31 @@ var push = cli.Command{
 			api.WithKeys(keys),
 			api.WithDepFiles(deps),
 			api.WithTag(cmd.String("tag")),
+			api.WithTagPrefix(stringSliceFlagRender([]string{cmd.String("prefix")}, workdir)[0]),
+			api.WithTagLength(cmd.Int("tag-length")),
+			api.WithHashScheme(cmd.String("hash-scheme")),
 			api.WithFiles(files),
 			api.WithWorkdir(workdir),
 			api.WithPlatform(platform),
-			api.WithProfile(profile, func() string {
-				if profileStdin {
-					return "content"
-				}
-				if len(profileFile) != 0 {
-					return "file"
-				}
-				return ""
-			}()),
+			api.WithNoSymlinks(cmd.Bool("no-symlinks")),
+			api.WithNoHardlinks(cmd.Bool("no-hardlinks")),
+			api.WithNoDirs(cmd.Bool("no-dirs")),
+			api.WithNoModes(cmd.Bool("no-mode")),
+			api.WithNoMtimes(cmd.Bool("no-mtime")),
+			api.WithReproducible(cmd.Bool("reproducible")),
+			api.WithLayerSplit(cmd.String("split")),
+			api.WithLayerDepth(cmd.Int("split-depth")),
+			api.WithLayerCount(cmd.Int("split-layers")),
+			api.WithProfile(profile, profileType),
+			blobCache,
 			api.WithOutputStdout(output == "stdout"),
 			api.WithOutputFile(output),
 			api.WithForcePush(cmd.Bool("force")),
+			api.WithSkipUnchanged(cmd.Bool("skip-unchanged")),
+			api.WithMountFrom(cmd.StringSlice("mount-from")),
+			api.WithBase(stringSliceFlagRender([]string{cmd.String("base")}, workdir)[0]),
+			api.WithMaxDepth(cmd.Int("max-depth")),
 		)
+		return errors.Join(err, writeResultJSON(cmd.String("result-json"), result, err))
 	},
 }
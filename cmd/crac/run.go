@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"slices"
+
+	"github.com/ssuf1998dev/container-registry-as-cache/api"
+	"github.com/ssuf1998dev/container-registry-as-cache/internal/utils"
+	"github.com/urfave/cli/v3"
+)
+
+// pickFlags returns flags of names in order, it panics if a name is not found, so picking a flag
+// from the wrong command fails at start rather than dropping it silently.
+func pickFlags(flags []cli.Flag, names ...string) []cli.Flag {
+	picked := []cli.Flag{}
+	for _, name := range names {
+		i := slices.IndexFunc(flags, func(f cli.Flag) bool {
+			return slices.Contains(f.Names(), name)
+		})
+		if i < 0 {
+			panic(fmt.Sprintf("flag \"%s\" is not found", name))
+		}
+		picked = append(picked, flags[i])
+	}
+	return picked
+}
+
+var run = cli.Command{
+	Name:        "run",
+	Usage:       "pull cache image, run a command, then push cache image if it was a miss and the command succeeds",
+	Description: "the tag is computed once before running the command, cache file(s) are scanned after it",
+	ArgsUsage:   "[repository] -- <command>",
+	Suggest:     false,
+	Arguments: []cli.Argument{
+		&cli.StringArg{Name: "repo"},
+	},
+	Flags: slices.Concat(
+		pickFlags(pull.Flags,
+			"backend", "key", "dep", "tag", "prefix", "tag-length", "hash-scheme", "restore-key", "workdir", "platform", "perm", "unknown-platform", "atomic",
+		),
+		pickFlags(push.Flags, "file", "mount-from", "reproducible", "split", "split-depth", "split-layers", "base", "max-depth"),
+		pickFlags(pull.Flags,
+			"no-symlinks", "no-hardlinks", "no-dirs", "no-mode", "no-mtime", "max-entries", "max-size",
+			"blob-cache", "blob-cache-size", "no-blob-cache",
+			"profile", "profile-file", "profile-stdin",
+			"username", "password", "force-http", "insecure",
+		),
+	),
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		slog.Debug("running...")
+
+		workdir := cmd.String("workdir")
+
+		repo := cmd.StringArg("repo")
+		if len(repo) == 0 {
+			return fmt.Errorf("argument repository is required")
+		}
+		args := cmd.Args().Slice()
+		if len(args) == 0 {
+			return fmt.Errorf("command is required after \"--\"")
+		}
+
+		keys := stringSliceFlagRender(cmd.StringSlice("key"), workdir)
+		deps := utils.ScanFiles(stringSliceFlagRender(cmd.StringSlice("dep"), workdir))
+		profile, profileType, err := readProfile(cmd)
+		if err != nil {
+			return err
+		}
+
+		maxSize, err := parseMaxSize(cmd.String("max-size"))
+		if err != nil {
+			return err
+		}
+
+		platform := cmd.String("platform")
+		if cmd.Bool("unknown-platform") {
+			platform = "unknown/unknown"
+		}
+
+		blobCache, err := blobCacheOption(cmd)
+		if err != nil {
+			return err
+		}
+
+		_, _, err = api.Run(
+			func(ctx context.Context) error {
+				c := exec.CommandContext(ctx, args[0], args[1:]...)
+				c.Dir = workdir
+				c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
+				// *exec.ExitError is a cli.ExitCoder, so crac exits with the code of the command if it fails
+				return c.Run()
+			},
+			api.WithContext(ctx),
+			api.WithRepository(repo),
+			api.WithBackendType(cmd.String("backend")),
+			api.WithUsername(cmd.String("username")),
+			api.WithPassword(cmd.String("password")),
+			api.WithForceHttp(cmd.Bool("force-http")),
+			api.WithInsecure(cmd.Bool("insecure")),
+			api.WithKeys(keys),
+			api.WithDepFiles(deps),
+			api.WithTag(cmd.String("tag")),
+			api.WithTagPrefix(stringSliceFlagRender([]string{cmd.String("prefix")}, workdir)[0]),
+			api.WithTagLength(cmd.Int("tag-length")),
+			api.WithHashScheme(cmd.String("hash-scheme")),
+			api.WithRestoreKeys(stringSliceFlagRender(cmd.StringSlice("restore-key"), workdir)),
+			api.WithWorkdir(workdir),
+			api.WithPlatform(platform),
+			api.WithNoSymlinks(cmd.Bool("no-symlinks")),
+			api.WithNoHardlinks(cmd.Bool("no-hardlinks")),
+			api.WithNoDirs(cmd.Bool("no-dirs")),
+			api.WithNoModes(cmd.Bool("no-mode")),
+			api.WithNoMtimes(cmd.Bool("no-mtime")),
+			api.WithReproducible(cmd.Bool("reproducible")),
+			api.WithLayerSplit(cmd.String("split")),
+			api.WithLayerDepth(cmd.Int("split-depth")),
+			api.WithLayerCount(cmd.Int("split-layers")),
+			api.WithBase(stringSliceFlagRender([]string{cmd.String("base")}, workdir)[0]),
+			api.WithMaxDepth(cmd.Int("max-depth")),
+			api.WithMaxEntries(cmd.Int("max-entries")),
+			api.WithMaxSize(maxSize),
+			api.WithAtomic(cmd.Bool("atomic")),
+			api.WithFilePerm(fs.FileMode(cmd.Uint32("perm"))),
+			api.WithFilePatterns(stringSliceFlagRender(cmd.StringSlice("file"), workdir)),
+			api.WithProfile(profile, profileType),
+			blobCache,
+			api.WithForcePush(true),
+			api.WithMountFrom(cmd.StringSlice("mount-from")),
+		)
+		return err
+	},
+}
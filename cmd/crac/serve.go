@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/ssuf1998dev/container-registry-as-cache/internal/registry"
+	"github.com/urfave/cli/v3"
+)
+
+var serve = cli.Command{
+	Name:        "serve",
+	Usage:       "run a local OCI registry",
+	Description: "everything is in memory unless \"--dir\" is set, push and pull with \"--force-http\" if TLS is not set",
+	Suggest:     false,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name: "addr", Aliases: []string{"a"}, Value: ":5000", Category: "BASIC",
+			Usage: "address to listen on",
+		},
+		&cli.StringFlag{
+			Name: "dir", Category: "BASIC",
+			Usage: "directory to store blobs and manifests in",
+		},
+		&cli.StringFlag{
+			Name: "htpasswd", Category: "AUTH",
+			Usage: "htpasswd file of bcrypt hashes, basic auth is required if set",
+		},
+		&cli.StringFlag{
+			Name: "realm", Value: "crac", Category: "AUTH",
+			Usage: "realm of basic auth",
+		},
+		&cli.StringFlag{
+			Name: "tls-cert", Category: "TLS",
+			Usage: "TLS certificate file",
+		},
+		&cli.StringFlag{
+			Name: "tls-key", Category: "TLS",
+			Usage: "TLS key file",
+		},
+	},
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		slog.Debug("serving...")
+
+		certFile, keyFile := cmd.String("tls-cert"), cmd.String("tls-key")
+		if (len(certFile) == 0) != (len(keyFile) == 0) {
+			return fmt.Errorf("\"--tls-cert\" and \"--tls-key\" are required together")
+		}
+
+		handler, err := registry.New(registry.Options{
+			Dir:      cmd.String("dir"),
+			Htpasswd: cmd.String("htpasswd"),
+			Realm:    cmd.String("realm"),
+			Logger:   slog.NewLogLogger(slog.Default().Handler(), slog.LevelDebug),
+		})
+		if err != nil {
+			return err
+		}
+
+		listener, err := net.Listen("tcp", cmd.String("addr"))
+		if err != nil {
+			return err
+		}
+		server := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+
+		ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		go func() {
+			<-ctx.Done()
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			server.Shutdown(shutdownCtx)
+		}()
+
+		slog.Info(
+			"registry listening",
+			"addr", listener.Addr().String(),
+			"dir", cmd.String("dir"),
+			"auth", len(cmd.String("htpasswd")) != 0,
+			"tls", len(certFile) != 0,
+		)
+		if len(certFile) != 0 {
+			err = server.ServeTLS(listener, certFile, keyFile)
+		} else {
+			err = server.Serve(listener)
+		}
+		if errors.Is(err, http.ErrServerClosed) {
+			slog.Info("registry stopped")
+			return nil
+		}
+		return err
+	},
+}
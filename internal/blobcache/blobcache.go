@@ -0,0 +1,329 @@
+package blobcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/ssuf1998dev/container-registry-as-cache/internal/utils"
+)
+
+// DefaultMaxSize is the size cap of a cache if not set.
+const DefaultMaxSize int64 = 8 << 30
+
+// DefaultDir returns "crac/blobs" in the user cache directory, "$XDG_CACHE_HOME" on linux.
+func DefaultDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, utils.Crac, "blobs"), nil
+}
+
+// Cache is a content-addressable store of compressed layers keyed by digest, the least
+// recently used blobs are evicted when the total size exceeds the cap.
+type Cache struct {
+	dir     string
+	maxSize int64
+	mu      sync.Mutex
+}
+
+// New returns a cache in dir, maxSize 0 means DefaultMaxSize and negative means no limit.
+func New(dir string, maxSize int64) *Cache {
+	if maxSize == 0 {
+		maxSize = DefaultMaxSize
+	}
+	return &Cache{dir: dir, maxSize: maxSize}
+}
+
+// path returns the file of the blob of h, digests come from manifests, so anything but sha256
+// in lowercase hex is rejected rather than joined into a path.
+func (c *Cache) path(h v1.Hash) (string, error) {
+	if h.Algorithm != "sha256" || len(h.Hex) != 64 || strings.Trim(h.Hex, "0123456789abcdef") != "" {
+		return "", fmt.Errorf("digest \"%s\" is invalid", h)
+	}
+	return filepath.Join(c.dir, h.Algorithm, h.Hex), nil
+}
+
+// Open opens the blob of h, the error matches fs.ErrNotExist if it is not cached. The blob is
+// verified against h once read to the end, a mismatched one fails reading and closing, and is
+// removed from the cache.
+func (c *Cache) Open(h v1.Hash) (io.ReadCloser, error) {
+	p, err := c.path(h)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	// mtime is the last use for eviction
+	now := time.Now()
+	_ = os.Chtimes(p, now, now)
+	return &verifyReadCloser{f: f, digest: h, h: sha256.New()}, nil
+}
+
+// verifyReadCloser hashes a cached blob while it is read, since files on disk could be
+// corrupted or tampered with.
+type verifyReadCloser struct {
+	f      *os.File
+	digest v1.Hash
+	h      hash.Hash
+	err    error
+}
+
+func (v *verifyReadCloser) Read(p []byte) (int, error) {
+	if v.err != nil {
+		return 0, v.err
+	}
+	n, err := v.f.Read(p)
+	v.h.Write(p[:n])
+	if err == io.EOF {
+		if sum := hex.EncodeToString(v.h.Sum(nil)); sum != v.digest.Hex {
+			v.err = fmt.Errorf("cached blob \"%s\" mismatches its digest, sha256 is \"%s\"", v.digest, sum)
+			os.Remove(v.f.Name())
+			return n, v.err
+		}
+	}
+	return n, err
+}
+
+func (v *verifyReadCloser) Close() error {
+	return errors.Join(v.f.Close(), v.err)
+}
+
+// Has tells if the blob of h is cached.
+func (c *Cache) Has(h v1.Hash) bool {
+	p, err := c.path(h)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(p)
+	return err == nil
+}
+
+// writer writes a blob into a temp file, it is renamed into the cache on commit if
+// the content matches the digest.
+type writer struct {
+	c      *Cache
+	digest v1.Hash
+	f      *os.File
+	h      hash.Hash
+	n      int64
+}
+
+func (c *Cache) newWriter(digest v1.Hash) (*writer, error) {
+	p, err := c.path(digest)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(p)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	return &writer{c: c, digest: digest, f: f, h: sha256.New()}, nil
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	n, err := w.f.Write(p)
+	w.h.Write(p[:n])
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *writer) commit() error {
+	defer os.Remove(w.f.Name())
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	if hex.EncodeToString(w.h.Sum(nil)) != w.digest.Hex {
+		return fmt.Errorf("blob \"%s\" is incomplete", w.digest)
+	}
+	if w.c.maxSize > 0 && w.n > w.c.maxSize {
+		return nil
+	}
+	p, err := w.c.path(w.digest)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(w.f.Name(), p); err != nil {
+		return err
+	}
+	return w.c.Evict()
+}
+
+func (w *writer) abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+// Evict removes the least recently used blobs until the total size is under the cap.
+func (c *Cache) Evict() error {
+	if c.maxSize < 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	type blob struct {
+		path  string
+		size  int64
+		mtime time.Time
+	}
+	blobs := []blob{}
+	var total int64
+	err := filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		blobs = append(blobs, blob{path: path, size: fi.Size(), mtime: fi.ModTime()})
+		total += fi.Size()
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].mtime.Before(blobs[j].mtime) })
+	for _, b := range blobs {
+		if total <= c.maxSize {
+			break
+		}
+		if err := os.Remove(b.path); err == nil || errors.Is(err, fs.ErrNotExist) {
+			total -= b.size
+		}
+	}
+	return nil
+}
+
+// Layer wraps l, its compressed content is read from the cache if the digest is cached,
+// otherwise it is written into the cache while being read.
+func (c *Cache) Layer(l v1.Layer) (v1.Layer, error) {
+	return partial.CompressedToLayer(&layer{inner: l, c: c})
+}
+
+type layer struct {
+	inner v1.Layer
+	c     *Cache
+}
+
+func (l *layer) Digest() (v1.Hash, error)            { return l.inner.Digest() }
+func (l *layer) DiffID() (v1.Hash, error)            { return l.inner.DiffID() }
+func (l *layer) Size() (int64, error)                { return l.inner.Size() }
+func (l *layer) MediaType() (types.MediaType, error) { return l.inner.MediaType() }
+
+func (l *layer) Compressed() (io.ReadCloser, error) {
+	digest, err := l.inner.Digest()
+	if err != nil {
+		return nil, err
+	}
+	if rc, err := l.c.Open(digest); err == nil {
+		return rc, nil
+	}
+
+	rc, err := l.inner.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	w, err := l.c.newWriter(digest)
+	if err != nil {
+		// caching is best effort
+		return rc, nil
+	}
+	return &teeReadCloser{rc: rc, w: w}, nil
+}
+
+// teeReadCloser writes what is read into the cache, the blob is committed on close if
+// all of it has been read.
+type teeReadCloser struct {
+	rc     io.ReadCloser
+	w      *writer
+	failed bool
+	closed bool
+}
+
+func (t *teeReadCloser) Read(p []byte) (int, error) {
+	n, err := t.rc.Read(p)
+	if n > 0 && !t.failed {
+		if _, werr := t.w.Write(p[:n]); werr != nil {
+			t.failed = true
+		}
+	}
+	return n, err
+}
+
+func (t *teeReadCloser) Close() error {
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	err := t.rc.Close()
+	if err != nil || t.failed {
+		t.w.abort()
+		return err
+	}
+	// an incomplete or mismatched blob is simply not cached
+	_ = t.w.commit()
+	return nil
+}
+
+// Dir returns the directory of the cache.
+func (c *Cache) Dir() string {
+	return c.dir
+}
+
+// Image wraps layers of img with Layer.
+func (c *Cache) Image(img v1.Image) v1.Image {
+	return &image{Image: img, c: c}
+}
+
+type image struct {
+	v1.Image
+	c *Cache
+}
+
+func (i *image) Layers() ([]v1.Layer, error) {
+	layers, err := i.Image.Layers()
+	if err != nil {
+		return nil, err
+	}
+	wrapped := make([]v1.Layer, len(layers))
+	for idx, l := range layers {
+		if wrapped[idx], err = i.c.Layer(l); err != nil {
+			return nil, err
+		}
+	}
+	return wrapped, nil
+}
+
+func (i *image) LayerByDigest(h v1.Hash) (v1.Layer, error) {
+	l, err := i.Image.LayerByDigest(h)
+	if err != nil {
+		return nil, err
+	}
+	return i.c.Layer(l)
+}
@@ -0,0 +1,147 @@
+package blobcache
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// brokenLayer fails reading content, it tells a layer is read from the cache.
+type brokenLayer struct {
+	v1.Layer
+}
+
+func (brokenLayer) Compressed() (io.ReadCloser, error) {
+	return nil, errors.New("broken")
+}
+
+func readAll(t *testing.T, l v1.Layer) []byte {
+	rc, err := l.Compressed()
+	require.NoError(t, err)
+	b, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	return b
+}
+
+func TestCache_Layer(t *testing.T) {
+	c := New(t.TempDir(), -1)
+	inner, err := random.Layer(1024, "application/vnd.docker.image.rootfs.diff.tar.gzip")
+	require.NoError(t, err)
+	digest, _ := inner.Digest()
+
+	l, err := c.Layer(inner)
+	require.NoError(t, err)
+	want := readAll(t, l)
+	assert.True(t, c.Has(digest))
+
+	l, err = c.Layer(brokenLayer{inner})
+	require.NoError(t, err)
+	assert.Equal(t, want, readAll(t, l))
+
+	rc, err := l.Uncompressed()
+	require.NoError(t, err)
+	_, err = io.Copy(io.Discard, rc)
+	require.NoError(t, err)
+	rc.Close()
+}
+
+func TestCache_Incomplete(t *testing.T) {
+	c := New(t.TempDir(), -1)
+	inner, _ := random.Layer(1024, "application/vnd.docker.image.rootfs.diff.tar.gzip")
+	digest, _ := inner.Digest()
+
+	l, _ := c.Layer(inner)
+	rc, err := l.Compressed()
+	require.NoError(t, err)
+	_, err = rc.Read(make([]byte, 16))
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	assert.False(t, c.Has(digest))
+
+	entries, _ := os.ReadDir(filepath.Join(c.dir, digest.Algorithm))
+	assert.Empty(t, entries)
+}
+
+func TestCache_Tampered(t *testing.T) {
+	c := New(t.TempDir(), -1)
+	inner, _ := random.Layer(1024, "application/vnd.docker.image.rootfs.diff.tar.gzip")
+	digest, _ := inner.Digest()
+	l, _ := c.Layer(inner)
+	readAll(t, l)
+	p, err := c.path(digest)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(p, []byte("tampered"), 0644))
+
+	l, _ = c.Layer(brokenLayer{inner})
+	rc, err := l.Compressed()
+	require.NoError(t, err)
+	_, err = io.ReadAll(rc)
+	require.ErrorContains(t, err, "mismatches its digest")
+	require.Error(t, rc.Close())
+	assert.False(t, c.Has(digest))
+}
+
+func TestCache_Evict(t *testing.T) {
+	layers := []v1.Layer{}
+	var size int64
+	for range 4 {
+		inner, _ := random.Layer(1024, "application/vnd.docker.image.rootfs.diff.tar.gzip")
+		layers = append(layers, inner)
+		n, _ := inner.Size()
+		size = max(size, n)
+	}
+	// room for three layers
+	c := New(t.TempDir(), size*3+size/2)
+
+	digests := []v1.Hash{}
+	for i, inner := range layers[:3] {
+		digest, _ := inner.Digest()
+		digests = append(digests, digest)
+		l, _ := c.Layer(inner)
+		readAll(t, l)
+		past := time.Now().Add(time.Duration(i-10) * time.Minute)
+		p, err := c.path(digest)
+		require.NoError(t, err)
+		require.NoError(t, os.Chtimes(p, past, past))
+	}
+	// the first one is used recently, the second one is the least recently used
+	rc, err := c.Open(digests[0])
+	require.NoError(t, err)
+	rc.Close()
+
+	digest, _ := layers[3].Digest()
+	l, _ := c.Layer(layers[3])
+	readAll(t, l)
+
+	assert.True(t, c.Has(digest))
+	assert.True(t, c.Has(digests[0]))
+	assert.False(t, c.Has(digests[1]))
+}
+
+func TestCache_InvalidDigest(t *testing.T) {
+	root := t.TempDir()
+	c := New(filepath.Join(root, "cache"), -1)
+	// a file outside the cache that a crafted digest would point to
+	require.NoError(t, os.WriteFile(filepath.Join(root, "secret"), []byte("secret"), 0644))
+
+	for _, h := range []v1.Hash{
+		{Algorithm: "..", Hex: "secret"},
+		{Algorithm: "sha256", Hex: "../../secret"},
+		{Algorithm: "sha512", Hex: "0000000000000000000000000000000000000000000000000000000000000000"},
+		{Algorithm: "sha256", Hex: "ABCDEF0000000000000000000000000000000000000000000000000000000000"},
+	} {
+		assert.False(t, c.Has(h), h.String())
+		_, err := c.Open(h)
+		assert.Error(t, err, h.String())
+		assert.False(t, errors.Is(err, os.ErrNotExist), h.String())
+	}
+}
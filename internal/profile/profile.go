@@ -18,7 +18,8 @@ import (
 )
 
 type ProfileFiles struct {
-	Value map[string]string
+	Value    map[string]string
+	Patterns []string
 }
 
 func (f *ProfileFiles) UnmarshalYAML(raw ast.Node) error {
@@ -33,6 +34,7 @@ func (f *ProfileFiles) UnmarshalYAML(raw ast.Node) error {
 		}
 
 		f.Value = utils.ScanFiles(patterns)
+		f.Patterns = patterns
 	}
 	return nil
 }
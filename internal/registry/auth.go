@@ -0,0 +1,77 @@
+package registry
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// readHtpasswd reads "user:hash" lines, only bcrypt hashes are supported like registry:3.
+func readHtpasswd(file string) (map[string][]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := map[string][]byte{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(text, ":")
+		if !ok || len(user) == 0 {
+			return nil, fmt.Errorf("htpasswd \"%s\" is invalid, line %d", file, line)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("htpasswd \"%s\" is invalid, line %d is not bcrypt", file, line)
+		}
+		users[user] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// dummyHash returns a hash to compare with for unknown users, of the highest cost in users and at
+// least bcrypt.DefaultCost, so they take as long as known ones.
+func dummyHash(users map[string][]byte, realm string) []byte {
+	cost := bcrypt.DefaultCost
+	for _, hash := range users {
+		if c, err := bcrypt.Cost(hash); err == nil && c > cost {
+			cost = c
+		}
+	}
+	dummy, _ := bcrypt.GenerateFromPassword([]byte(realm), cost)
+	return dummy
+}
+
+func basicAuth(next http.Handler, users map[string][]byte, realm string) http.Handler {
+	dummy := dummyHash(users, realm)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if ok {
+			hash, known := users[username]
+			if !known {
+				hash = dummy
+			}
+			err := bcrypt.CompareHashAndPassword(hash, []byte(password))
+			ok = known && err == nil
+		}
+		if !ok {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=\"%s\"", realm))
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"errors":[{"code":"UNAUTHORIZED","message":"authentication required"}]}`)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,274 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+type Options struct {
+	// Dir keeps blobs and manifests on disk if set, otherwise everything is in memory.
+	Dir string
+	// Htpasswd is a htpasswd file of bcrypt hashes, basic auth is required if set.
+	Htpasswd string
+	Realm    string
+	Logger   *log.Logger
+}
+
+// New returns an OCI distribution registry handler, manifests stored in Dir are loaded.
+func New(opts Options) (http.Handler, error) {
+	logger := opts.Logger
+	if logger == nil {
+		logger = log.New(io.Discard, "", 0)
+	}
+	regOpts := []ggcrregistry.Option{ggcrregistry.Logger(logger)}
+
+	var store *manifestStore
+	if len(opts.Dir) != 0 {
+		blobs := filepath.Join(opts.Dir, "blobs")
+		if err := os.MkdirAll(blobs, 0755); err != nil {
+			return nil, err
+		}
+		regOpts = append(regOpts, ggcrregistry.WithBlobHandler(ggcrregistry.NewDiskBlobHandler(blobs)))
+		store = &manifestStore{dir: filepath.Join(opts.Dir, "manifests"), log: logger}
+	}
+
+	var handler http.Handler = ggcrregistry.New(regOpts...)
+	if store != nil {
+		if err := store.load(handler); err != nil {
+			return nil, err
+		}
+		handler = store.wrap(handler)
+	}
+
+	if len(opts.Htpasswd) != 0 {
+		users, err := readHtpasswd(opts.Htpasswd)
+		if err != nil {
+			return nil, err
+		}
+		realm := opts.Realm
+		if len(realm) == 0 {
+			realm = "crac"
+		}
+		handler = basicAuth(handler, users, realm)
+	}
+	return handler, nil
+}
+
+// manifestStore persists manifests since the registry only keeps them in memory.
+type manifestStore struct {
+	dir string
+	log *log.Logger
+}
+
+type storedManifest struct {
+	MediaType string `json:"mediaType"`
+	Manifest  []byte `json:"manifest"`
+}
+
+// manifestPath splits "/v2/<name>/manifests/<reference>", ok is false for other paths.
+func manifestPath(path string) (repo string, ref string, ok bool) {
+	elems := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(elems) < 4 || elems[0] != "v2" || elems[len(elems)-2] != "manifests" {
+		return "", "", false
+	}
+	repo, ref = strings.Join(elems[1:len(elems)-2], "/"), elems[len(elems)-1]
+	if len(repo) == 0 || len(ref) == 0 || ref == "." || ref == ".." {
+		return "", "", false
+	}
+	return repo, ref, true
+}
+
+// pathComponent is a component of repository names in the OCI distribution spec.
+var pathComponent = regexp.MustCompile(`^[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*$`)
+
+// validRepository tells whether repo is a valid repository name, which also stays inside the
+// directory of manifests once escaped, since components like ".." pass the character check of
+// name.NewRepository but not the grammar of the spec.
+func validRepository(repo string) bool {
+	if _, err := name.NewRepository(repo); err != nil {
+		return false
+	}
+	for _, c := range strings.Split(repo, "/") {
+		if !pathComponent.MatchString(c) {
+			return false
+		}
+	}
+	return filepath.IsLocal(url.QueryEscape(repo))
+}
+
+func (s *manifestStore) file(repo string, ref string) string {
+	return filepath.Join(s.dir, url.QueryEscape(repo), url.QueryEscape(ref))
+}
+
+func (s *manifestStore) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		repo, ref, ok := manifestPath(r.URL.Path)
+		if ok && !validRepository(repo) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"errors":[{"code":"NAME_INVALID","message":"invalid repository name"}]}`)
+			return
+		}
+		if !ok || (r.Method != http.MethodPut && r.Method != http.MethodDelete) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var body []byte
+		if r.Method == http.MethodPut {
+			b, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			body = b
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+
+		var err error
+		switch {
+		case r.Method == http.MethodPut && sw.status == http.StatusCreated:
+			err = s.save(repo, ref, storedManifest{MediaType: r.Header.Get("Content-Type"), Manifest: body})
+		case r.Method == http.MethodDelete && sw.status == http.StatusAccepted:
+			err = os.Remove(s.file(repo, ref))
+			if os.IsNotExist(err) {
+				err = nil
+			}
+		}
+		if err != nil {
+			s.log.Printf("manifest \"%s:%s\" is not persisted, %s", repo, ref, err)
+		}
+	})
+}
+
+func (s *manifestStore) save(repo string, ref string, m storedManifest) error {
+	file := s.file(repo, ref)
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmp := fmt.Sprintf("%s.tmp", file)
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// load replays stored manifests into the registry, images before indexes
+// since the registry checks manifests of an index exist.
+func (s *manifestStore) load(handler http.Handler) error {
+	repos, err := os.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	type entry struct {
+		repo, ref string
+		m         storedManifest
+	}
+	entries := []entry{}
+	for _, repoEntry := range repos {
+		repo, err := url.QueryUnescape(repoEntry.Name())
+		if err != nil || !repoEntry.IsDir() {
+			continue
+		}
+		refs, err := os.ReadDir(filepath.Join(s.dir, repoEntry.Name()))
+		if err != nil {
+			return err
+		}
+		for _, refEntry := range refs {
+			if strings.HasSuffix(refEntry.Name(), ".tmp") {
+				continue
+			}
+			ref, err := url.QueryUnescape(refEntry.Name())
+			if err != nil {
+				continue
+			}
+			b, err := os.ReadFile(filepath.Join(s.dir, repoEntry.Name(), refEntry.Name()))
+			if err != nil {
+				return err
+			}
+			var m storedManifest
+			if err := json.Unmarshal(b, &m); err != nil {
+				return fmt.Errorf("manifest \"%s:%s\" is invalid, %s", repo, ref, err)
+			}
+			entries = append(entries, entry{repo: repo, ref: ref, m: m})
+		}
+	}
+	slices.SortStableFunc(entries, func(a, b entry) int {
+		ai, bi := types.MediaType(a.m.MediaType).IsIndex(), types.MediaType(b.m.MediaType).IsIndex()
+		switch {
+		case ai == bi:
+			return 0
+		case ai:
+			return 1
+		default:
+			return -1
+		}
+	})
+
+	for _, e := range entries {
+		req, err := http.NewRequest(
+			http.MethodPut,
+			fmt.Sprintf("/v2/%s/manifests/%s", e.repo, e.ref),
+			bytes.NewReader(e.m.Manifest),
+		)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", e.m.MediaType)
+		sw := &statusWriter{ResponseWriter: discardWriter{header: http.Header{}}}
+		handler.ServeHTTP(sw, req)
+		if sw.status != http.StatusCreated {
+			return fmt.Errorf("manifest \"%s:%s\" is not loaded, status %d", e.repo, e.ref, sw.status)
+		}
+	}
+	return nil
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+type discardWriter struct {
+	header http.Header
+}
+
+func (w discardWriter) Header() http.Header         { return w.header }
+func (w discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w discardWriter) WriteHeader(int)             {}
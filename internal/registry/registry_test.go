@@ -0,0 +1,121 @@
+package registry
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func serve(t *testing.T, opts Options) string {
+	handler, err := New(opts)
+	require.NoError(t, err)
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+func TestNew_Persist(t *testing.T) {
+	dir := t.TempDir()
+	img, err := random.Image(64, 2)
+	require.NoError(t, err)
+	digest, _ := img.Digest()
+
+	ref, err := name.ParseReference(fmt.Sprintf("%s/crac/foo:bar", serve(t, Options{Dir: dir})), name.Insecure)
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(ref, img))
+	require.NoError(t, remote.Tag(ref.Context().Tag("baz"), img))
+	require.NoError(t, remote.Delete(ref.Context().Tag("baz")))
+
+	// a new registry on the same directory has what the old one had
+	host := serve(t, Options{Dir: dir})
+	ref, _ = name.ParseReference(fmt.Sprintf("%s/crac/foo:bar", host), name.Insecure)
+	got, err := remote.Image(ref)
+	require.NoError(t, err)
+	gotDigest, _ := got.Digest()
+	assert.Equal(t, digest, gotDigest)
+	layers, _ := got.Layers()
+	for _, layer := range layers {
+		rc, err := layer.Compressed()
+		require.NoError(t, err)
+		rc.Close()
+	}
+
+	tags, err := remote.List(ref.Context())
+	require.NoError(t, err)
+	assert.Contains(t, tags, "bar")
+	assert.NotContains(t, tags, "baz")
+
+	entries, _ := os.ReadDir(filepath.Join(dir, "blobs", "sha256"))
+	assert.NotEmpty(t, entries)
+}
+
+func TestNew_InvalidRepository(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "registry")
+	host := serve(t, Options{Dir: dir})
+
+	for _, repo := range []string{"..", "crac/..", "Crac"} {
+		req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("http://%s/v2/%s/manifests/evil", host, repo), strings.NewReader("{}"))
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, repo)
+	}
+
+	entries, _ := os.ReadDir(root)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "registry", entries[0].Name())
+}
+
+func TestNew_Htpasswd(t *testing.T) {
+	host := serve(t, Options{Htpasswd: "../../testdata/htpasswd"})
+	img, _ := random.Image(64, 1)
+	ref, _ := name.ParseReference(fmt.Sprintf("%s/crac/foo:bar", host), name.Insecure)
+
+	err := remote.Write(ref, img)
+	require.Error(t, err)
+
+	err = remote.Write(ref, img, remote.WithAuth(&authn.Basic{Username: "testuser", Password: "wrongpassword"}))
+	require.Error(t, err)
+
+	err = remote.Write(ref, img, remote.WithAuth(&authn.Basic{Username: "testuser", Password: "testpassword"}))
+	require.NoError(t, err)
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/v2/", host))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, `Basic realm="crac"`, resp.Header.Get("WWW-Authenticate"))
+}
+
+func TestNew_HtpasswdInvalid(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "htpasswd")
+	require.NoError(t, os.WriteFile(file, []byte("testuser:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"), 0644))
+	_, err := New(Options{Htpasswd: file})
+	require.Error(t, err)
+}
+
+func TestDummyHash(t *testing.T) {
+	cost := func(users map[string][]byte) int {
+		c, err := bcrypt.Cost(dummyHash(users, "crac"))
+		require.NoError(t, err)
+		return c
+	}
+	assert.Equal(t, bcrypt.DefaultCost, cost(nil))
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.DefaultCost+1)
+	require.NoError(t, err)
+	assert.Equal(t, bcrypt.DefaultCost+1, cost(map[string][]byte{"user": hash}))
+}
@@ -0,0 +1,113 @@
+package tarhelper
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// UntarAtomic extracts r into a staging directory next to dst, calls verify with what is extracted,
+// then moves entries of the staging directory into dst by renaming. Like Untar, directories existing
+// in dst are merged into rather than replaced, so only paths the archive contains are swapped, each
+// existing one is backed up and restored if anything fails, dst is left untouched then.
+func UntarAtomic(r io.Reader, dst string, opts Options, verify func(Stats) error) (stats Stats, err error) {
+	if len(dst) == 0 {
+		dst = "."
+	}
+	dst, err = filepath.Abs(dst)
+	if err != nil {
+		return stats, err
+	}
+	if err := os.MkdirAll(dst, 0766); err != nil {
+		return stats, err
+	}
+
+	parent, base := filepath.Dir(dst), filepath.Base(dst)
+	staging, err := os.MkdirTemp(parent, fmt.Sprintf(".%s.staging-*", base))
+	if err != nil {
+		return stats, err
+	}
+	defer os.RemoveAll(staging)
+
+	if stats, err = Untar(r, staging, opts); err != nil {
+		return stats, err
+	}
+	if verify != nil {
+		if err = verify(stats); err != nil {
+			return stats, err
+		}
+	}
+
+	backup, err := os.MkdirTemp(parent, fmt.Sprintf(".%s.backup-*", base))
+	if err != nil {
+		return stats, err
+	}
+
+	type swapped struct {
+		name   string
+		backed bool
+	}
+	done := []swapped{}
+	defer func() {
+		if err == nil {
+			os.RemoveAll(backup)
+			return
+		}
+		// roll back in reverse order, backup is kept if rolling back fails
+		var rollbackErr error
+		for i := len(done) - 1; i >= 0; i-- {
+			target := filepath.Join(dst, done[i].name)
+			if e := os.RemoveAll(target); e != nil {
+				rollbackErr = e
+				continue
+			}
+			if done[i].backed {
+				if e := os.Rename(filepath.Join(backup, done[i].name), target); e != nil {
+					rollbackErr = e
+				}
+			}
+		}
+		if rollbackErr != nil {
+			err = fmt.Errorf("%w, rolling back failed, original entries are kept in \"%s\", %w", err, backup, rollbackErr)
+			return
+		}
+		os.RemoveAll(backup)
+	}()
+
+	var swap func(dir string) error
+	swap = func(dir string) error {
+		entries, err := os.ReadDir(filepath.Join(staging, dir))
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			name := filepath.Join(dir, entry.Name())
+			target := filepath.Join(dst, name)
+			fi, err := os.Lstat(target)
+			if err == nil && entry.IsDir() && fi.IsDir() {
+				if err := swap(name); err != nil {
+					return err
+				}
+				continue
+			}
+			item := swapped{name: name}
+			if err == nil {
+				if err := os.MkdirAll(filepath.Dir(filepath.Join(backup, name)), 0700); err != nil {
+					return err
+				}
+				if err := os.Rename(target, filepath.Join(backup, name)); err != nil {
+					return err
+				}
+				item.backed = true
+			}
+			done = append(done, item)
+			if err := os.Rename(filepath.Join(staging, name), target); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err = swap(".")
+	return stats, err
+}
@@ -0,0 +1,112 @@
+package tarhelper
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUntarAtomic(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "workdir")
+	require.NoError(t, os.MkdirAll(filepath.Join(dst, "node_modules", "stale"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dst, "package.json"), []byte("{}"), 0644))
+
+	data := makeTar(t,
+		&tar.Header{Name: "node_modules/a", Typeflag: tar.TypeReg},
+		&tar.Header{Name: ".pnpm/b", Typeflag: tar.TypeReg},
+	)
+	stats, err := UntarAtomic(bytes.NewReader(data), dst, Options{}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, Stats{Entries: 2, Files: 2, Size: 21}, stats)
+
+	b, err := os.ReadFile(filepath.Join(dst, "node_modules", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, "node_modules/a", string(b))
+	// directories are merged into like Untar
+	_, err = os.Stat(filepath.Join(dst, "node_modules", "stale"))
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dst, "package.json"))
+	assert.NoError(t, err)
+
+	siblings, _ := os.ReadDir(filepath.Dir(dst))
+	assert.Len(t, siblings, 1)
+}
+
+func TestUntarAtomic_Merge(t *testing.T) {
+	// a pnpm monorepo caches node_modules of packages, not their sources
+	dst := filepath.Join(t.TempDir(), "workdir")
+	require.NoError(t, os.MkdirAll(filepath.Join(dst, "packages", "a", "node_modules", "old"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dst, "packages", "a", "index.js"), []byte("src"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dst, "packages", "a", "node_modules", "dep"), []byte("old"), 0644))
+
+	data := makeTar(t,
+		&tar.Header{Name: "packages/a/node_modules/dep", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "packages/b/node_modules/dep", Typeflag: tar.TypeReg},
+	)
+	_, err := UntarAtomic(bytes.NewReader(data), dst, Options{}, nil)
+	require.NoError(t, err)
+
+	b, err := os.ReadFile(filepath.Join(dst, "packages", "a", "index.js"))
+	require.NoError(t, err)
+	assert.Equal(t, "src", string(b))
+	b, err = os.ReadFile(filepath.Join(dst, "packages", "a", "node_modules", "dep"))
+	require.NoError(t, err)
+	assert.Equal(t, "packages/a/node_modules/dep", string(b))
+	_, err = os.Stat(filepath.Join(dst, "packages", "b", "node_modules", "dep"))
+	assert.NoError(t, err)
+	siblings, _ := os.ReadDir(filepath.Dir(dst))
+	assert.Len(t, siblings, 1)
+
+	// failing keeps paths not in the archive as well
+	_, err = UntarAtomic(bytes.NewReader(data), dst, Options{}, func(Stats) error { return errors.New("digest mismatch") })
+	require.Error(t, err)
+	b, err = os.ReadFile(filepath.Join(dst, "packages", "a", "index.js"))
+	require.NoError(t, err)
+	assert.Equal(t, "src", string(b))
+}
+
+func TestUntarAtomic_Failure(t *testing.T) {
+	for _, item := range []struct {
+		name   string
+		data   []byte
+		verify func(Stats) error
+	}{
+		{
+			name: "bad entry",
+			data: makeTar(t,
+				&tar.Header{Name: "node_modules/a", Typeflag: tar.TypeReg},
+				&tar.Header{Name: "../evil", Typeflag: tar.TypeReg},
+			),
+		},
+		{
+			name: "truncated",
+			data: makeTar(t, &tar.Header{Name: "node_modules/a", Typeflag: tar.TypeReg})[:520],
+		},
+		{
+			name:   "verify",
+			data:   makeTar(t, &tar.Header{Name: "node_modules/a", Typeflag: tar.TypeReg}),
+			verify: func(Stats) error { return errors.New("digest mismatch") },
+		},
+	} {
+		t.Run(item.name, func(t *testing.T) {
+			dst := filepath.Join(t.TempDir(), "workdir")
+			require.NoError(t, os.MkdirAll(filepath.Join(dst, "node_modules"), 0755))
+			require.NoError(t, os.WriteFile(filepath.Join(dst, "node_modules", "a"), []byte("old"), 0644))
+
+			_, err := UntarAtomic(bytes.NewReader(item.data), dst, Options{}, item.verify)
+			require.Error(t, err)
+
+			b, err := os.ReadFile(filepath.Join(dst, "node_modules", "a"))
+			require.NoError(t, err)
+			assert.Equal(t, "old", string(b))
+			siblings, _ := os.ReadDir(filepath.Dir(dst))
+			assert.Len(t, siblings, 1)
+		})
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !windows
+
+package tarhelper
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// fileIDOf returns the identity of a file having more than one hard link.
+func fileIDOf(fi fs.FileInfo) (fileID, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink <= 1 {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
@@ -0,0 +1,14 @@
+//go:build windows
+
+package tarhelper
+
+import (
+	"io/fs"
+)
+
+type fileID struct{}
+
+// fileIDOf always reports no hard link, file index is not exposed by fs.FileInfo on windows.
+func fileIDOf(fi fs.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
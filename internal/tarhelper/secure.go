@@ -0,0 +1,136 @@
+package tarhelper
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+const (
+	DefaultMaxEntries = 4 << 20
+	DefaultMaxSize    = 64 << 30
+)
+
+var (
+	ErrEntryOutside   = errors.New("entry resolves outside of destination")
+	ErrLinkOutside    = errors.New("link target resolves outside of destination")
+	ErrThroughSymlink = errors.New("entry is written through a symlink from the same archive")
+	ErrTooManyEntries = errors.New("too many entries")
+	ErrTooLarge       = errors.New("total size is too large")
+)
+
+// EntryError names the bad entry causing extraction to fail.
+type EntryError struct {
+	Name string
+	Err  error
+}
+
+func (e *EntryError) Error() string {
+	return fmt.Sprintf("invalid entry \"%s\", %s", e.Name, e.Err)
+}
+
+func (e *EntryError) Unwrap() error {
+	return e.Err
+}
+
+// localName makes name relative to the destination, leading slashes are dropped
+// like header names always being relative to dst, but ".." escaping is rejected.
+func localName(name string) (string, error) {
+	local := strings.TrimLeft(filepath.Clean(filepath.FromSlash(name)), string(filepath.Separator))
+	if len(local) == 0 {
+		local = "."
+	}
+	if !filepath.IsLocal(local) {
+		return "", ErrEntryOutside
+	}
+	return local, nil
+}
+
+// maxSymlinkHops caps symlinks followed when resolving a symlink target, like ELOOP.
+const maxSymlinkHops = 255
+
+// localLinkname resolves a symlink target relative to the directory of the link, following
+// symlinks created earlier by the same archive, absolute targets or ones escaping the
+// destination are rejected.
+func localLinkname(local string, linkname string, symlinks symlinkSet) error {
+	linkname = filepath.FromSlash(linkname)
+	if filepath.IsAbs(linkname) || len(filepath.VolumeName(linkname)) != 0 {
+		return ErrLinkOutside
+	}
+	_, err := symlinks.resolve(filepath.Dir(local), linkname)
+	return err
+}
+
+// symlinkSet records symlinks created by the archive being extracted, with their targets.
+type symlinkSet map[string]string
+
+func (s symlinkSet) key(local string) string {
+	// default file systems of these are case-insensitive
+	if runtime.GOOS == "darwin" || runtime.GOOS == "windows" {
+		return strings.ToLower(local)
+	}
+	return local
+}
+
+func (s symlinkSet) add(local string, linkname string) {
+	s[s.key(local)] = filepath.FromSlash(linkname)
+}
+
+func (s symlinkSet) delete(local string) {
+	delete(s, s.key(local))
+}
+
+// resolve walks linkname from dir component by component, a recorded symlink in the middle is
+// replaced by its target, since the kernel follows it before applying the rest, so lexically
+// cleaning "l/../.." would hide where it points. The last component is not followed, as the
+// target of a recorded symlink is already checked when it is created.
+func (s symlinkSet) resolve(dir string, linkname string) (string, error) {
+	split := func(p string) []string {
+		return slices.DeleteFunc(strings.Split(p, string(filepath.Separator)), func(c string) bool {
+			return len(c) == 0 || c == "."
+		})
+	}
+	resolved := split(dir)
+	rest := split(linkname)
+	hops := 0
+	for len(rest) != 0 {
+		c := rest[0]
+		rest = rest[1:]
+		if c == ".." {
+			if len(resolved) == 0 {
+				return "", ErrLinkOutside
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+		resolved = append(resolved, c)
+		target, ok := s[s.key(filepath.Join(resolved...))]
+		if !ok || len(rest) == 0 {
+			continue
+		}
+		if hops++; hops > maxSymlinkHops || filepath.IsAbs(target) {
+			return "", ErrLinkOutside
+		}
+		resolved = resolved[:len(resolved)-1]
+		rest = append(split(target), rest...)
+	}
+	return filepath.Join(resolved...), nil
+}
+
+func (s symlinkSet) has(local string) bool {
+	_, ok := s[s.key(local)]
+	return ok
+}
+
+// through reports whether local itself or any of its parents is a recorded symlink.
+func (s symlinkSet) through(local string) bool {
+	for p := local; p != "." && p != string(filepath.Separator); p = filepath.Dir(p) {
+		if s.has(p) {
+			return true
+		}
+	}
+	return false
+}
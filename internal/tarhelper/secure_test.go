@@ -0,0 +1,235 @@
+package tarhelper
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func makeTar(t testing.TB, headers ...*tar.Header) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, header := range headers {
+		if header.Typeflag == tar.TypeReg {
+			header.Size = int64(len(header.Name))
+		}
+		require.NoError(t, tw.WriteHeader(header))
+		if header.Typeflag == tar.TypeReg {
+			_, err := tw.Write([]byte(header.Name))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func TestUntar_Unsafe(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	for _, item := range []struct {
+		name    string
+		headers []*tar.Header
+		err     error
+	}{
+		{
+			name:    "parent",
+			headers: []*tar.Header{{Name: "../evil", Typeflag: tar.TypeReg}},
+			err:     ErrEntryOutside,
+		},
+		{
+			name:    "nested parent",
+			headers: []*tar.Header{{Name: "a/../../evil", Typeflag: tar.TypeReg}},
+			err:     ErrEntryOutside,
+		},
+		{
+			name:    "absolute symlink",
+			headers: []*tar.Header{{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc"}},
+			err:     ErrLinkOutside,
+		},
+		{
+			name:    "relative symlink",
+			headers: []*tar.Header{{Name: "a/link", Typeflag: tar.TypeSymlink, Linkname: "../../etc"}},
+			err:     ErrLinkOutside,
+		},
+		{
+			name:    "hardlink",
+			headers: []*tar.Header{{Name: "link", Typeflag: tar.TypeLink, Linkname: "../evil"}},
+			err:     ErrLinkOutside,
+		},
+		{
+			name: "through symlink",
+			headers: []*tar.Header{
+				{Name: "dir", Typeflag: tar.TypeDir},
+				{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "dir"},
+				{Name: "link/evil", Typeflag: tar.TypeReg},
+			},
+			err: ErrThroughSymlink,
+		},
+		{
+			name: "onto symlink",
+			headers: []*tar.Header{
+				{Name: "file", Typeflag: tar.TypeReg},
+				{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "file"},
+				{Name: "link", Typeflag: tar.TypeReg},
+			},
+			err: ErrThroughSymlink,
+		},
+		{
+			name: "symlink chain",
+			headers: []*tar.Header{
+				{Name: "d", Typeflag: tar.TypeDir},
+				{Name: "d/l", Typeflag: tar.TypeSymlink, Linkname: ".."},
+				{Name: "d/l2", Typeflag: tar.TypeSymlink, Linkname: "l/../.."},
+			},
+			err: ErrLinkOutside,
+		},
+		{
+			name: "symlink loop",
+			headers: []*tar.Header{
+				{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "b"},
+				{Name: "b", Typeflag: tar.TypeSymlink, Linkname: "a"},
+				{Name: "c", Typeflag: tar.TypeSymlink, Linkname: "a/x"},
+			},
+			err: ErrLinkOutside,
+		},
+		{
+			name: "hardlink to symlink",
+			headers: []*tar.Header{
+				{Name: "file", Typeflag: tar.TypeReg},
+				{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "file"},
+				{Name: "hard", Typeflag: tar.TypeLink, Linkname: "link"},
+			},
+			err: ErrThroughSymlink,
+		},
+	} {
+		t.Run(item.name, func(t *testing.T) {
+			root := t.TempDir()
+			dst := filepath.Join(root, "dst")
+			_, err := Untar(bytes.NewReader(makeTar(t, item.headers...)), dst, Options{})
+			require.ErrorIs(t, err, item.err)
+
+			var entryErr *EntryError
+			require.ErrorAs(t, err, &entryErr)
+			assert.Equal(t, item.headers[len(item.headers)-1].Name, entryErr.Name)
+
+			entries, _ := os.ReadDir(root)
+			for _, entry := range entries {
+				assert.Equal(t, "dst", entry.Name())
+			}
+		})
+	}
+}
+
+func TestUntar_SymlinkChain(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	// like pnpm, a bin link goes through a package symlink into the store
+	dst := t.TempDir()
+	_, err := Untar(bytes.NewReader(makeTar(t,
+		&tar.Header{Name: "node_modules/.pnpm/foo/bin", Typeflag: tar.TypeDir},
+		&tar.Header{Name: "node_modules/.pnpm/foo/bin/cli", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "node_modules/foo", Typeflag: tar.TypeSymlink, Linkname: ".pnpm/foo"},
+		&tar.Header{Name: "node_modules/.bin/foo", Typeflag: tar.TypeSymlink, Linkname: "../foo/bin/cli"},
+	)), dst, Options{})
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dst, "node_modules/.bin/foo"))
+	assert.NoError(t, err)
+}
+
+func TestUntar_Limits(t *testing.T) {
+	data := makeTar(t,
+		&tar.Header{Name: "a", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "b", Typeflag: tar.TypeReg},
+	)
+
+	_, err := Untar(bytes.NewReader(data), t.TempDir(), Options{MaxEntries: 1})
+	require.ErrorIs(t, err, ErrTooManyEntries)
+
+	_, err = Untar(bytes.NewReader(data), t.TempDir(), Options{MaxSize: 1})
+	require.ErrorIs(t, err, ErrTooLarge)
+
+	_, err = Untar(bytes.NewReader(data), t.TempDir(), Options{MaxEntries: -1, MaxSize: -1})
+	require.NoError(t, err)
+}
+
+func FuzzWalkTar(f *testing.F) {
+	f.Add(makeTar(f, &tar.Header{Name: "a", Typeflag: tar.TypeReg}))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		WalkTar(bytes.NewReader(data), func(header *tar.Header, fi os.FileInfo, r io.Reader) (bool, error) {
+			_, err := io.Copy(io.Discard, r)
+			return false, err
+		})
+	})
+}
+
+func FuzzUntar(f *testing.F) {
+	f.Add("a/b", "../c", byte(tar.TypeSymlink))
+	f.Add("a", "a", byte(tar.TypeLink))
+	f.Add("../a", "", byte(tar.TypeReg))
+	f.Add("/a/./b/", "", byte(tar.TypeDir))
+	f.Add("a/b", "/etc/passwd", byte(tar.TypeSymlink))
+	f.Add("d/l2", "l/../..", byte(tar.TypeSymlink))
+
+	f.Fuzz(func(t *testing.T, name string, linkname string, typeflag byte) {
+		if runtime.GOOS == "windows" {
+			t.Skip()
+		}
+		if len(name) == 0 || strings.ContainsRune(name, 0) || strings.ContainsRune(linkname, 0) {
+			t.Skip()
+		}
+
+		root := t.TempDir()
+		dst := filepath.Join(root, "dst")
+		require.NoError(t, os.Mkdir(dst, 0755))
+
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, header := range []*tar.Header{
+			// seeds may chain through this symlink
+			{Name: "d", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "d/l", Linkname: "..", Typeflag: tar.TypeSymlink},
+			{Name: name, Linkname: linkname, Typeflag: typeflag, Mode: 0644},
+			{Name: name + "/x", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: linkname + "/y", Typeflag: tar.TypeReg, Mode: 0644},
+		} {
+			if err := tw.WriteHeader(header); err != nil {
+				t.Skip()
+			}
+		}
+		tw.Close()
+
+		Untar(bytes.NewReader(buf.Bytes()), dst, Options{})
+
+		entries, err := os.ReadDir(root)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		require.Equal(t, "dst", entries[0].Name())
+
+		realDst, err := filepath.EvalSymlinks(dst)
+		require.NoError(t, err)
+		filepath.WalkDir(dst, func(p string, d os.DirEntry, err error) error {
+			if err != nil || d.Type()&os.ModeSymlink == 0 {
+				return nil
+			}
+			if resolved, err := filepath.EvalSymlinks(p); err == nil {
+				rel, _ := filepath.Rel(realDst, resolved)
+				require.True(t, filepath.IsLocal(rel) || rel == ".", "symlink %s resolves to %s", p, resolved)
+			}
+			return nil
+		})
+	})
+}
@@ -2,24 +2,200 @@ package tarhelper
 
 import (
 	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"maps"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 )
 
-func WalkTar(r io.Reader, callback func(header *tar.Header, fi os.FileInfo, data []byte) (bool, error)) error {
-	tr := tar.NewReader(r)
-	for header, err := tr.Next(); err != io.EOF; header, err = tr.Next() {
-		if err != nil {
+// Options controls which metadata are kept when making or extracting a tar, zero value keeps all of them.
+type Options struct {
+	NoSymlinks  bool
+	NoHardlinks bool
+	NoDirs      bool
+	NoModes     bool
+	NoMtimes    bool
+
+	// FilePerm overrides modes of all extracted regular files if not zero.
+	FilePerm fs.FileMode
+	// Mtime overrides mtimes of all archived entries if not zero, unless NoMtimes.
+	Mtime time.Time
+
+	// MaxEntries and MaxSize cap the entry count and the total size of regular files when extracting,
+	// DefaultMaxEntries and DefaultMaxSize are used if zero, no limit if negative.
+	MaxEntries int
+	MaxSize    int64
+
+	// Checksums makes Untar record the sha256 of regular files into Stats.
+	Checksums bool
+}
+
+// Tar writes files into w in name order, files maps entry names to paths on disk.
+func Tar(w io.Writer, files map[string]string, opts Options) error {
+	return TarDelta(w, files, nil, opts)
+}
+
+// WhiteoutPrefix marks an OCI whiteout entry, which deletes the entry of the same name without
+// the prefix from lower layers.
+const WhiteoutPrefix = ".wh."
+
+// Whiteout returns the name of the whiteout entry deleting name.
+func Whiteout(name string) string {
+	name = path.Clean(filepath.ToSlash(name))
+	return path.Join(path.Dir(name), WhiteoutPrefix+path.Base(name))
+}
+
+// IsWhiteout tells whether an entry name is a whiteout, and returns the name it deletes.
+func IsWhiteout(name string) (string, bool) {
+	name = path.Clean(name)
+	base := path.Base(name)
+	if !strings.HasPrefix(base, WhiteoutPrefix) {
+		return "", false
+	}
+	return path.Join(path.Dir(name), strings.TrimPrefix(base, WhiteoutPrefix)), true
+}
+
+// TarDelta is like Tar but also writes a whiteout entry for each of deleted, a layer made of it
+// applies on top of lower layers.
+func TarDelta(w io.Writer, files map[string]string, deleted []string, opts Options) error {
+	whiteouts := map[string]bool{}
+	for _, name := range deleted {
+		whiteouts[Whiteout(name)] = true
+	}
+	names := slices.Concat(slices.Collect(maps.Keys(files)), slices.Collect(maps.Keys(whiteouts)))
+	slices.Sort(names)
+
+	tw := tar.NewWriter(w)
+	links := map[fileID]string{}
+	for _, name := range names {
+		if whiteouts[name] {
+			header := &tar.Header{Name: name, Typeflag: tar.TypeReg, ModTime: opts.Mtime}
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := writeEntry(tw, name, files[name], opts, links); err != nil {
 			return err
 		}
-		b, err := io.ReadAll(tr)
+	}
+	return tw.Close()
+}
+
+func writeEntry(tw *tar.Writer, name string, path string, opts Options, links map[fileID]string) error {
+	header, fi, err := fileHeader(name, path, opts)
+	if err != nil || header == nil {
+		return err
+	}
+	if header.Typeflag != tar.TypeReg {
+		return tw.WriteHeader(header)
+	}
+
+	if id, ok := fileIDOf(fi); ok && !opts.NoHardlinks {
+		if first, ok := links[id]; ok {
+			header.Typeflag = tar.TypeLink
+			header.Linkname = first
+			header.Size = 0
+			return tw.WriteHeader(header)
+		}
+		links[id] = header.Name
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(tw, f, header.Size); err != nil {
+		return fmt.Errorf("file \"%s\" changed while archiving, %w", path, err)
+	}
+	return nil
+}
+
+// FileHeader returns the header archiving path as name, nil if it is not archived. Hard links are
+// not told, a regular file is always of tar.TypeReg.
+func FileHeader(name string, path string, opts Options) (*tar.Header, error) {
+	header, _, err := fileHeader(name, path, opts)
+	return header, err
+}
+
+func fileHeader(name string, path string, opts Options) (*tar.Header, fs.FileInfo, error) {
+	name = filepath.ToSlash(filepath.Clean(name))
+	if name == "." {
+		return nil, nil, nil
+	}
+
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if fi.Mode()&fs.ModeSymlink != 0 && opts.NoSymlinks {
+		if fi, err = os.Stat(path); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// ownership, access and change times are never archived, so headers only depend on
+	// names, modes, mtimes and contents
+	header := &tar.Header{Name: name}
+	if !opts.NoModes {
+		header.Mode = int64(fi.Mode().Perm())
+	}
+	if !opts.NoMtimes {
+		header.ModTime = fi.ModTime()
+		if !opts.Mtime.IsZero() {
+			header.ModTime = opts.Mtime
+		}
+	}
+
+	switch {
+	case fi.Mode()&fs.ModeSymlink != 0:
+		link, err := os.Readlink(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		header.Typeflag = tar.TypeSymlink
+		header.Linkname = filepath.ToSlash(link)
+
+	case fi.IsDir():
+		if opts.NoDirs {
+			return nil, nil, nil
+		}
+		header.Typeflag = tar.TypeDir
+		header.Name += "/"
+
+	case fi.Mode().IsRegular():
+		header.Typeflag = tar.TypeReg
+		header.Size = fi.Size()
+
+	default:
+		// sockets, devices and so on are not cache content
+		return nil, nil, nil
+	}
+	return header, fi, nil
+}
+
+// WalkTar calls callback for every entry, r reads the content of the current entry
+// and is only valid until callback returns, so nothing is buffered here.
+func WalkTar(r io.Reader, callback func(header *tar.Header, fi os.FileInfo, r io.Reader) (bool, error)) error {
+	tr := tar.NewReader(r)
+	for header, err := tr.Next(); err != io.EOF; header, err = tr.Next() {
 		if err != nil {
 			return err
 		}
-		stop, err := callback(header, header.FileInfo(), b)
+		stop, err := callback(header, header.FileInfo(), tr)
 		if stop {
 			return nil
 		}
@@ -30,64 +206,248 @@ func WalkTar(r io.Reader, callback func(header *tar.Header, fi os.FileInfo, data
 	return nil
 }
 
+// UntarFile reads the whole content of the entry named path into memory, the error matches
+// fs.ErrNotExist if there is no such entry.
 func UntarFile(r io.Reader, path string) ([]byte, error) {
 	var b []byte
-	err := WalkTar(r, func(header *tar.Header, fi os.FileInfo, data []byte) (bool, error) {
+	found := false
+	err := WalkTar(r, func(header *tar.Header, fi os.FileInfo, r io.Reader) (bool, error) {
 		if header.Name == path {
-			b = data
-			return true, nil
+			data, err := io.ReadAll(r)
+			b, found = data, true
+			return true, err
 		}
 		return false, nil
 	})
 	if err != nil {
 		return nil, err
 	}
-	if len(b) == 0 {
-		return nil, fmt.Errorf("file \"%s\" not found", path)
+	if !found {
+		return nil, fmt.Errorf("entry \"%s\" not found, %w", path, fs.ErrNotExist)
 	}
 	return b, nil
 }
 
-func Untar(r io.Reader, dst string, filePerm fs.FileMode) error {
-	return WalkTar(r, func(header *tar.Header, fi os.FileInfo, data []byte) (bool, error) {
-		// force to make header.Name relative to dst
-		target := filepath.Join(dst, header.Name)
+// Stats counts what Untar extracted.
+type Stats struct {
+	Entries int
+	Files   int
+	Size    int64
+	// Checksums maps entry names of regular files to their sha256, only with Options.Checksums.
+	Checksums map[string]string
+}
+
+// Untar extracts r into dst, an entry resolving outside dst, a symlink targeting outside dst
+// or an entry written through a symlink created by the same archive fails the extraction.
+func Untar(r io.Reader, dst string, opts Options) (Stats, error) {
+	if len(dst) == 0 {
+		dst = "."
+	}
+	maxEntries := opts.MaxEntries
+	if maxEntries == 0 {
+		maxEntries = DefaultMaxEntries
+	}
+	maxSize := opts.MaxSize
+	if maxSize == 0 {
+		maxSize = DefaultMaxSize
+	}
+
+	// modes and mtimes of directories are applied at last,
+	// since creating entries inside changes mtime and a read-only directory blocks writing
+	dirs := []*tar.Header{}
+	symlinks := symlinkSet{}
+	stats := Stats{}
+	if opts.Checksums {
+		stats.Checksums = map[string]string{}
+	}
+
+	err := WalkTar(r, func(header *tar.Header, fi os.FileInfo, r io.Reader) (bool, error) {
+		stats.Entries++
+		if maxEntries > 0 && stats.Entries > maxEntries {
+			return false, &EntryError{Name: header.Name, Err: ErrTooManyEntries}
+		}
+		if header.Typeflag == tar.TypeReg {
+			stats.Files++
+			stats.Size += header.Size
+			if maxSize > 0 && stats.Size > maxSize {
+				return false, &EntryError{Name: header.Name, Err: ErrTooLarge}
+			}
+		}
+
+		local, err := localName(header.Name)
+		if err != nil {
+			return false, &EntryError{Name: header.Name, Err: err}
+		}
+		if symlinks.through(filepath.Dir(local)) {
+			return false, &EntryError{Name: header.Name, Err: ErrThroughSymlink}
+		}
+		target := filepath.Join(dst, local)
 
 		switch header.Typeflag {
 
 		case tar.TypeDir:
-			if _, err := os.Stat(target); err != nil {
-				if err := os.MkdirAll(target, 0766); err != nil {
-					return false, err
-				}
+			if opts.NoDirs {
+				return false, nil
+			}
+			if symlinks.has(local) {
+				return false, &EntryError{Name: header.Name, Err: ErrThroughSymlink}
+			}
+			if err := os.MkdirAll(target, 0766); err != nil {
+				return false, err
 			}
+			dirs = append(dirs, header)
 
 		case tar.TypeReg:
-			dir := filepath.Dir(target)
-			if _, err := os.Stat(dir); err != nil {
-				if err := os.MkdirAll(dir, 0766); err != nil {
-					return false, err
-				}
+			if symlinks.has(local) {
+				return false, &EntryError{Name: header.Name, Err: ErrThroughSymlink}
 			}
-
-			mode := os.FileMode(0755)
-			if filePerm != 0 {
-				mode = filePerm
-			} else if header.Mode != 0 {
-				mode = os.FileMode(header.Mode)
+			if err := mkdirParent(target); err != nil {
+				return false, err
 			}
-			f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR, mode)
-			if err != nil {
+			if err := removeIfSymlink(target); err != nil {
+				return false, err
+			}
+			h := sha256.New()
+			if opts.Checksums {
+				r = io.TeeReader(r, h)
+			}
+			if err := writeFile(target, r, fileMode(header, opts)); err != nil {
+				return false, err
+			}
+			if opts.Checksums {
+				stats.Checksums[header.Name] = hex.EncodeToString(h.Sum(nil))
+			}
+			if err := chtimes(target, header, opts); err != nil {
 				return false, err
 			}
 
-			if _, err := f.Write(data); err != nil {
+		case tar.TypeSymlink:
+			if opts.NoSymlinks {
+				return false, nil
+			}
+			if err := localLinkname(local, header.Linkname, symlinks); err != nil {
+				return false, &EntryError{Name: header.Name, Err: err}
+			}
+			if err := mkdirParent(target); err != nil {
 				return false, err
 			}
+			if err := removeIfExists(target); err != nil {
+				return false, err
+			}
+			if err := os.Symlink(filepath.FromSlash(header.Linkname), target); err != nil {
+				return false, err
+			}
+			symlinks.add(local, header.Linkname)
 
+		case tar.TypeLink:
+			linkLocal, err := localName(header.Linkname)
+			if err != nil {
+				return false, &EntryError{Name: header.Name, Err: ErrLinkOutside}
+			}
+			if symlinks.through(linkLocal) {
+				return false, &EntryError{Name: header.Name, Err: ErrThroughSymlink}
+			}
+			if err := mkdirParent(target); err != nil {
+				return false, err
+			}
+			if err := removeIfExists(target); err != nil {
+				return false, err
+			}
+			symlinks.delete(local)
+			source := filepath.Join(dst, linkLocal)
+			if !opts.NoHardlinks {
+				if err := os.Link(source, target); err != nil {
+					return false, err
+				}
+				return false, nil
+			}
+			f, err := os.Open(source)
+			if err != nil {
+				return false, err
+			}
+			err = writeFile(target, f, fileMode(header, opts))
 			f.Close()
+			if err != nil {
+				return false, err
+			}
+			if err := chtimes(target, header, opts); err != nil {
+				return false, err
+			}
 		}
 
 		return false, nil
 	})
+	if err != nil {
+		return stats, err
+	}
+
+	for _, header := range slices.Backward(dirs) {
+		local, _ := localName(header.Name)
+		if symlinks.has(local) {
+			continue
+		}
+		target := filepath.Join(dst, local)
+		if !opts.NoModes && header.Mode != 0 {
+			if err := os.Chmod(target, os.FileMode(header.Mode).Perm()); err != nil {
+				return stats, err
+			}
+		}
+		if err := chtimes(target, header, opts); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+func fileMode(header *tar.Header, opts Options) fs.FileMode {
+	if opts.FilePerm != 0 {
+		return opts.FilePerm
+	}
+	if !opts.NoModes && header.Mode != 0 {
+		return os.FileMode(header.Mode).Perm()
+	}
+	return 0755
+}
+
+func mkdirParent(target string) error {
+	dir := filepath.Dir(target)
+	if _, err := os.Stat(dir); err != nil {
+		return os.MkdirAll(dir, 0766)
+	}
+	return nil
+}
+
+func removeIfExists(target string) error {
+	if err := os.Remove(target); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func removeIfSymlink(target string) error {
+	if fi, err := os.Lstat(target); err == nil && fi.Mode()&fs.ModeSymlink != 0 {
+		return os.Remove(target)
+	}
+	return nil
+}
+
+func writeFile(target string, r io.Reader, mode fs.FileMode) error {
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return err
+	}
+	// the file may exist before, or umask is applied
+	return f.Chmod(mode)
+}
+
+func chtimes(target string, header *tar.Header, opts Options) error {
+	if opts.NoMtimes || header.ModTime.IsZero() {
+		return nil
+	}
+	return os.Chtimes(target, header.ModTime, header.ModTime)
 }
@@ -0,0 +1,165 @@
+package tarhelper
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestTree(t *testing.T) (string, map[string]string) {
+	src := t.TempDir()
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "bin"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "empty"), 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "lib.js"), []byte("foo"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "run.sh"), []byte("#!/bin/sh"), 0700))
+	require.NoError(t, os.Symlink("../run.sh", filepath.Join(src, "bin", "run")))
+	require.NoError(t, os.Link(filepath.Join(src, "lib.js"), filepath.Join(src, "lib.hard.js")))
+	for _, name := range []string{"lib.js", "run.sh", "empty"} {
+		require.NoError(t, os.Chtimes(filepath.Join(src, name), mtime, mtime))
+	}
+
+	files := map[string]string{}
+	for _, name := range []string{"bin", "bin/run", "empty", "lib.js", "lib.hard.js", "run.sh"} {
+		files[name] = filepath.Join(src, name)
+	}
+	return src, files
+}
+
+func TestTar_RoundTrip(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	_, files := newTestTree(t)
+	var buf bytes.Buffer
+	require.NoError(t, Tar(&buf, files, Options{}))
+
+	dst := t.TempDir()
+	_, err := Untar(bytes.NewReader(buf.Bytes()), dst, Options{})
+	require.NoError(t, err)
+
+	link, err := os.Readlink(filepath.Join(dst, "bin", "run"))
+	require.NoError(t, err)
+	assert.Equal(t, "../run.sh", link)
+
+	fi, err := os.Stat(filepath.Join(dst, "run.sh"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), fi.Mode().Perm())
+	assert.True(t, fi.ModTime().Equal(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)))
+
+	fi, err = os.Stat(filepath.Join(dst, "empty"))
+	require.NoError(t, err)
+	assert.True(t, fi.IsDir())
+	assert.Equal(t, os.FileMode(0700), fi.Mode().Perm())
+	assert.True(t, fi.ModTime().Equal(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)))
+
+	a, err := os.Stat(filepath.Join(dst, "lib.js"))
+	require.NoError(t, err)
+	b, err := os.Stat(filepath.Join(dst, "lib.hard.js"))
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(a, b))
+}
+
+func TestTar_OptOut(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	_, files := newTestTree(t)
+	opts := Options{NoSymlinks: true, NoHardlinks: true, NoDirs: true, NoModes: true, NoMtimes: true}
+	var buf bytes.Buffer
+	require.NoError(t, Tar(&buf, files, opts))
+
+	dst := t.TempDir()
+	_, err := Untar(bytes.NewReader(buf.Bytes()), dst, opts)
+	require.NoError(t, err)
+
+	fi, err := os.Lstat(filepath.Join(dst, "bin", "run"))
+	require.NoError(t, err)
+	assert.True(t, fi.Mode().IsRegular())
+	assert.Equal(t, os.FileMode(0755), fi.Mode().Perm())
+
+	_, err = os.Stat(filepath.Join(dst, "empty"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	a, err := os.Stat(filepath.Join(dst, "lib.js"))
+	require.NoError(t, err)
+	b, err := os.Stat(filepath.Join(dst, "lib.hard.js"))
+	require.NoError(t, err)
+	assert.False(t, os.SameFile(a, b))
+}
+
+func TestTar_Mtime(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	epoch := time.Unix(0, 0)
+	tars := [][]byte{}
+	for _, mtime := range []time.Time{time.Now(), time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)} {
+		src, files := newTestTree(t)
+		for _, name := range []string{"bin", "lib.js", "run.sh", "empty"} {
+			require.NoError(t, os.Chtimes(filepath.Join(src, name), mtime, mtime))
+		}
+		var buf bytes.Buffer
+		require.NoError(t, Tar(&buf, files, Options{Mtime: epoch}))
+		tars = append(tars, buf.Bytes())
+	}
+	assert.Equal(t, tars[0], tars[1])
+
+	err := WalkTar(bytes.NewReader(tars[0]), func(header *tar.Header, fi os.FileInfo, r io.Reader) (bool, error) {
+		assert.True(t, header.ModTime.Equal(epoch), header.Name)
+		assert.Zero(t, header.Uid)
+		assert.Empty(t, header.Uname)
+		return false, nil
+	})
+	require.NoError(t, err)
+}
+
+func TestUntar_Streaming(t *testing.T) {
+	const size = 64 << 20
+
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		if err := tw.WriteHeader(&tar.Header{Name: "big", Typeflag: tar.TypeReg, Size: size, Mode: 0644}); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err := io.CopyN(tw, zeroReader{}, size); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(tw.Close())
+	}()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	dst := t.TempDir()
+	stats, err := Untar(pr, dst, Options{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(size), stats.Size)
+	runtime.ReadMemStats(&after)
+
+	fi, err := os.Stat(filepath.Join(dst, "big"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(size), fi.Size())
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(size/4))
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
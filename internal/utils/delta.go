@@ -0,0 +1,199 @@
+package utils
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/ssuf1998dev/container-registry-as-cache/internal/tarhelper"
+)
+
+// DeltaLayer is a TarLayer of entries added or changed since a base cache image, with whiteouts
+// of entries deleted since then. Regular files and symlinks are compared by the entries and the
+// checksums of the base, so a changed mode, type or symlink target is archived as well, hard
+// links of the base by the files they link to, directories are always archived since they are
+// only headers.
+//
+// Checksums, Entries and RegularFiles tell all of them after applying it on top of the base.
+type DeltaLayer struct {
+	*TarLayer
+	base          map[string]EntryMeta
+	unchanged     map[string]string
+	unchangedSize int64
+}
+
+func NewDeltaLayer(files map[string]string, workdir string, opts tarhelper.Options, checksums map[string]string, entries map[string]EntryMeta) (*DeltaLayer, error) {
+	all, err := NewTarLayer(files, workdir, opts)
+	if err != nil {
+		return nil, err
+	}
+	delta := &DeltaLayer{TarLayer: &TarLayer{entries: map[string]string{}, opts: opts}, base: entries, unchanged: map[string]string{}}
+	present := map[string]bool{}
+	headers := map[string]*tar.Header{}
+	links := map[string]string{}
+	for name, p := range all.entries {
+		name = filepath.ToSlash(filepath.Clean(name))
+		for dir := name; dir != "." && dir != "/"; dir = path.Dir(dir) {
+			present[dir] = true
+		}
+		header, err := tarhelper.FileHeader(name, p, opts)
+		if err != nil {
+			return nil, err
+		}
+		if header != nil {
+			headers[name] = header
+		}
+		base := entries[name]
+		if base.Type == tar.TypeLink && header != nil && header.Typeflag == tar.TypeReg {
+			// a hard link of the base is compared by the file it links to
+			same, err := sameEntry(header, p, EntryMeta{Type: tar.TypeReg, Mode: base.Mode}, checksums[base.Linkname])
+			if err != nil {
+				return nil, err
+			}
+			if same {
+				links[name] = p
+				continue
+			}
+		}
+		unchanged, err := sameEntry(header, p, base, checksums[name])
+		if err != nil {
+			return nil, err
+		}
+		if unchanged && header.Typeflag == tar.TypeReg {
+			delta.unchanged[name] = checksums[name]
+			delta.unchangedSize += header.Size
+		}
+		if !unchanged {
+			delta.entries[name] = p
+		}
+	}
+	// the link in the base is kept only if the file it links to is kept too, rather than
+	// deleted or replaced by the delta
+	for name, p := range links {
+		if _, ok := delta.unchanged[entries[name].Linkname]; !ok {
+			delta.entries[name] = p
+		}
+	}
+
+	// a deleted directory is whited out at its top, rather than every entry in it, and so is one
+	// replaced by another type, which would leave entries in it behind
+	whiteouts := map[string]bool{}
+	for name, e := range entries {
+		if header, ok := headers[name]; ok {
+			if e.Type == tar.TypeDir && header.Typeflag != tar.TypeDir {
+				whiteouts[name] = true
+			}
+			continue
+		}
+		if present[name] {
+			continue
+		}
+		parts := strings.Split(name, "/")
+		for i := range parts {
+			if dir := strings.Join(parts[:i+1], "/"); !present[dir] {
+				whiteouts[dir] = true
+				break
+			}
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(whiteouts)) {
+		// entries in a replaced directory are deleted with it
+		if !isWhitedOut(path.Dir(name), whiteouts) {
+			delta.whiteouts = append(delta.whiteouts, name)
+		}
+	}
+	return delta, nil
+}
+
+// sameEntry tells whether the entry archived by header is the same as the one of the base,
+// checksum is the sha256 of it if it is a regular file.
+func sameEntry(header *tar.Header, p string, base EntryMeta, checksum string) (bool, error) {
+	if header == nil || header.Typeflag != base.Type || header.Mode != base.Mode {
+		return false, nil
+	}
+	switch header.Typeflag {
+	case tar.TypeSymlink:
+		return header.Linkname == base.Linkname, nil
+	case tar.TypeReg:
+		if len(checksum) == 0 {
+			return false, nil
+		}
+		current, err := fileSha256(p)
+		return current == checksum, err
+	}
+	return false, nil
+}
+
+// isWhitedOut tells whether name or a directory of it is in whiteouts.
+func isWhitedOut(name string, whiteouts map[string]bool) bool {
+	for ; name != "." && name != "/"; name = path.Dir(name) {
+		if whiteouts[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// Empty tells there is nothing added, changed or deleted.
+func (l *DeltaLayer) Empty() bool {
+	return len(l.entries) == 0 && len(l.whiteouts) == 0
+}
+
+// Deleted returns the count of whiteouts.
+func (l *DeltaLayer) Deleted() int {
+	return len(l.whiteouts)
+}
+
+func (l *DeltaLayer) Checksums() (map[string]string, error) {
+	checksums, err := l.TarLayer.Checksums()
+	if err != nil {
+		return nil, err
+	}
+	all := maps.Clone(l.unchanged)
+	maps.Copy(all, checksums)
+	return all, nil
+}
+
+func (l *DeltaLayer) Entries() (map[string]EntryMeta, error) {
+	entries, err := l.TarLayer.Entries()
+	if err != nil {
+		return nil, err
+	}
+	whiteouts := map[string]bool{}
+	for _, name := range l.whiteouts {
+		whiteouts[name] = true
+	}
+	all := map[string]EntryMeta{}
+	for name, e := range l.base {
+		if !isWhitedOut(name, whiteouts) {
+			all[name] = e
+		}
+	}
+	maps.Copy(all, entries)
+	return all, nil
+}
+
+func (l *DeltaLayer) RegularFiles() (int, int64, error) {
+	files, size, err := l.TarLayer.RegularFiles()
+	return files + len(l.unchanged), size + l.unchangedSize, err
+}
+
+func fileSha256(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -2,73 +2,215 @@ package utils
 
 import (
 	"archive/tar"
-	"fmt"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
 	"os"
 	"path/filepath"
-	"sort"
 	"strings"
+	"sync"
 
 	v1 "github.com/google/go-containerregistry/pkg/v1"
-	"github.com/google/go-containerregistry/pkg/v1/tarball"
-	gonanoid "github.com/matoous/go-nanoid/v2"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/ssuf1998dev/container-registry-as-cache/internal/tarhelper"
 )
 
+// TarLayer streams files from disk into tar and gzip every time its content is read,
+// neither a temp file nor a per-file buffer is needed.
+//
+// Digest, DiffID and Size are computed by one pass of reading, so files are read once for
+// digest and once more for uploading.
 type TarLayer struct {
-	v1.Layer
-	File string
+	entries map[string]string
+	opts    tarhelper.Options
+	// whiteouts are entry names deleted from lower layers
+	whiteouts []string
+
+	once   sync.Once
+	digest v1.Hash
+	diffID v1.Hash
+	size   int64
+	usize  int64
+	err    error
+
+	// regular files in the tar, counted by the same pass
+	checksums map[string]string
+	files     int
+	fsize     int64
+	// all entries in the tar but whiteouts
+	entryMetas map[string]EntryMeta
 }
 
-func NewTarLayer(files map[string]string, workdir string) (*TarLayer, error) {
-	id, err := gonanoid.New()
-	if err != nil {
-		return nil, err
-	}
-	dst := filepath.Join(os.TempDir(), fmt.Sprintf("%s-%s.tar", Crac, id))
-	file, err := os.OpenFile(dst, os.O_CREATE|os.O_RDWR, 0644)
-	if err != nil {
-		return nil, err
-	}
+var _ v1.Layer = (*TarLayer)(nil)
 
-	tw := tar.NewWriter(file)
-	fn := []string{}
-	for f := range files {
-		fn = append(fn, f)
-	}
-	sort.Strings(fn)
+// gzipLevel is pinned rather than gzip.DefaultCompression, the same tar is always compressed
+// into the same bytes so layer digests are reproducible.
+const gzipLevel = 6
+
+func NewTarLayer(files map[string]string, workdir string, opts tarhelper.Options) (*TarLayer, error) {
 	if len(workdir) != 0 {
 		workdir, _ = filepath.Abs(workdir)
 	}
-	for _, f := range fn {
-		b, err := os.ReadFile(files[f])
-		if err != nil {
-			return nil, err
-		}
+	entries := map[string]string{}
+	for f, path := range files {
 		name := f
 		if len(workdir) != 0 {
-			rel, _ := filepath.Rel(workdir, files[f])
+			rel, _ := filepath.Rel(workdir, path)
 			dir := filepath.Clean(strings.ReplaceAll(rel, f, ""))
 			name = filepath.Join(dir, f)
 		}
-		if err := tw.WriteHeader(&tar.Header{
-			Name: name,
-			Size: int64(len(b)),
-		}); err != nil {
-			return nil, err
-		}
-		if _, err := tw.Write(b); err != nil {
-			return nil, err
-		}
+		entries[name] = path
 	}
-	if err := tw.Close(); err != nil {
-		return nil, err
+	return &TarLayer{entries: entries, opts: opts}, nil
+}
+
+func (l *TarLayer) Uncompressed() (io.ReadCloser, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(tarhelper.TarDelta(pw, l.entries, l.whiteouts, l.opts))
+	}()
+	return pr, nil
+}
+
+func (l *TarLayer) Compressed() (io.ReadCloser, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(l.writeCompressed(pw, io.Discard))
+	}()
+	return pr, nil
+}
+
+func (l *TarLayer) writeCompressed(w io.Writer, uncompressed io.Writer) error {
+	gw, err := gzip.NewWriterLevel(w, gzipLevel)
+	if err != nil {
+		return err
 	}
-	if err := file.Close(); err != nil {
-		return nil, err
+	if err := tarhelper.TarDelta(io.MultiWriter(gw, uncompressed), l.entries, l.whiteouts, l.opts); err != nil {
+		return err
 	}
+	return gw.Close()
+}
 
-	layer, err := tarball.LayerFromFile(dst)
+func (l *TarLayer) compute() error {
+	l.once.Do(func() {
+		digest, diffID := sha256.New(), sha256.New()
+		counter, ucounter := &countWriter{w: digest}, &countWriter{w: diffID}
+		pr, pw := io.Pipe()
+		walked := make(chan error, 1)
+		go func() {
+			err := l.walk(pr)
+			pr.CloseWithError(err)
+			walked <- err
+		}()
+		err := l.writeCompressed(counter, io.MultiWriter(ucounter, pw))
+		pw.CloseWithError(err)
+		if l.err = errors.Join(err, <-walked); l.err != nil {
+			return
+		}
+		l.digest = sha256Hash(digest)
+		l.diffID = sha256Hash(diffID)
+		l.size = counter.n
+		l.usize = ucounter.n
+	})
+	return l.err
+}
+
+// walk records entries and hashes regular files of the uncompressed tar.
+func (l *TarLayer) walk(r io.Reader) error {
+	l.checksums = map[string]string{}
+	l.entryMetas = map[string]EntryMeta{}
+	// files named like whiteouts are content unless written as whiteouts
+	whiteouts := map[string]bool{}
+	for _, name := range l.whiteouts {
+		whiteouts[tarhelper.Whiteout(name)] = true
+	}
+	err := tarhelper.WalkTar(r, func(header *tar.Header, fi os.FileInfo, r io.Reader) (bool, error) {
+		if whiteouts[header.Name] {
+			return false, nil
+		}
+		l.entryMetas[strings.TrimSuffix(header.Name, "/")] = EntryMeta{Type: header.Typeflag, Mode: header.Mode, Linkname: header.Linkname}
+		if header.Typeflag != tar.TypeReg {
+			return false, nil
+		}
+		h := sha256.New()
+		if _, err := io.Copy(h, r); err != nil {
+			return false, err
+		}
+		l.checksums[header.Name] = hex.EncodeToString(h.Sum(nil))
+		l.files++
+		l.fsize += header.Size
+		return false, nil
+	})
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return &TarLayer{Layer: layer, File: dst}, nil
+	// tar padding
+	_, err = io.Copy(io.Discard, r)
+	return err
+}
+
+func (l *TarLayer) Digest() (v1.Hash, error) {
+	err := l.compute()
+	return l.digest, err
+}
+
+func (l *TarLayer) DiffID() (v1.Hash, error) {
+	err := l.compute()
+	return l.diffID, err
+}
+
+func (l *TarLayer) Size() (int64, error) {
+	err := l.compute()
+	return l.size, err
+}
+
+// UncompressedSize returns the size of the tar before compressing.
+func (l *TarLayer) UncompressedSize() (int64, error) {
+	err := l.compute()
+	return l.usize, err
+}
+
+// Files returns the count of entries to archive, whiteouts are not counted.
+func (l *TarLayer) Files() int {
+	return len(l.entries)
+}
+
+// Checksums returns the sha256 of regular files by entry name.
+func (l *TarLayer) Checksums() (map[string]string, error) {
+	err := l.compute()
+	return l.checksums, err
+}
+
+// Entries returns all entries in the tar but whiteouts, by entry name without a trailing slash.
+func (l *TarLayer) Entries() (map[string]EntryMeta, error) {
+	err := l.compute()
+	return l.entryMetas, err
+}
+
+// RegularFiles returns the count and the total size of regular files in the tar.
+func (l *TarLayer) RegularFiles() (int, int64, error) {
+	err := l.compute()
+	return l.files, l.fsize, err
+}
+
+func (l *TarLayer) MediaType() (types.MediaType, error) {
+	return types.DockerLayer, nil
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func sha256Hash(h hash.Hash) v1.Hash {
+	return v1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(h.Sum(nil))}
 }
@@ -0,0 +1,201 @@
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/ssuf1998dev/container-registry-as-cache/internal/tarhelper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTarLayer(t *testing.T) {
+	layer, err := NewTarLayer(map[string]string{"foo": "../../testdata/foo"}, "", tarhelper.Options{})
+	require.NoError(t, err)
+
+	digest, err := layer.Digest()
+	require.NoError(t, err)
+	diffID, err := layer.DiffID()
+	require.NoError(t, err)
+	size, err := layer.Size()
+	require.NoError(t, err)
+
+	rc, err := layer.Compressed()
+	require.NoError(t, err)
+	actualDigest, actualSize, err := v1.SHA256(rc)
+	require.NoError(t, err)
+	rc.Close()
+	assert.Equal(t, digest, actualDigest)
+	assert.Equal(t, size, actualSize)
+
+	rc, err = layer.Uncompressed()
+	require.NoError(t, err)
+	actualDiffID, _, err := v1.SHA256(rc)
+	require.NoError(t, err)
+	rc.Close()
+	assert.Equal(t, diffID, actualDiffID)
+
+	rc, err = layer.Uncompressed()
+	require.NoError(t, err)
+	b, err := tarhelper.UntarFile(rc, "foo")
+	require.NoError(t, err)
+	rc.Close()
+	assert.Equal(t, "bar", string(b))
+
+	checksums, err := layer.Checksums()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"foo": "fcde2b2edba56bf408601fb721fe9b5c338d10ee429ea04fae5511b68fbf8fb9"}, checksums)
+	files, fsize, err := layer.RegularFiles()
+	require.NoError(t, err)
+	assert.Equal(t, 1, files)
+	assert.Equal(t, int64(3), fsize)
+}
+
+func TestNewTarLayer_MissingFile(t *testing.T) {
+	layer, err := NewTarLayer(map[string]string{"missing": "../../testdata/missing"}, "", tarhelper.Options{})
+	require.NoError(t, err)
+	_, err = layer.Digest()
+	require.Error(t, err)
+
+	rc, err := layer.Compressed()
+	require.NoError(t, err)
+	_, err = io.ReadAll(rc)
+	require.Error(t, err)
+}
+
+func TestNewDeltaLayer(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{}
+	for name, content := range map[string]string{"same": "same", "changed": "new", "added": "added", "exec": "exec"} {
+		p := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(p, []byte(content), 0644))
+		require.NoError(t, os.Chmod(p, 0644))
+		files[name] = p
+	}
+	require.NoError(t, os.Chmod(files["exec"], 0755))
+	for name, target := range map[string]string{"keep": "same", "link": "same", "swap": "same"} {
+		p := filepath.Join(dir, name)
+		require.NoError(t, os.Symlink(target, p))
+		files[name] = p
+	}
+	sum := func(s string) string {
+		h := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(h[:])
+	}
+	checksums := map[string]string{
+		"same": sum("same"), "changed": sum("old"), "exec": sum("exec"),
+		"gone/a": sum("a"), "gone/b": sum("b"), "swap/a": sum("a"),
+	}
+	reg := EntryMeta{Type: tar.TypeReg, Mode: 0644}
+	entries := map[string]EntryMeta{
+		"same": reg, "changed": reg, "exec": reg,
+		"gone": {Type: tar.TypeDir, Mode: 0755}, "gone/a": reg, "gone/b": reg,
+		"keep":    {Type: tar.TypeSymlink, Mode: 0777, Linkname: "same"},
+		"link":    {Type: tar.TypeSymlink, Mode: 0777, Linkname: "other"},
+		"oldlink": {Type: tar.TypeSymlink, Mode: 0777, Linkname: "same"},
+		"olddir":  {Type: tar.TypeDir, Mode: 0755},
+		"swap":    {Type: tar.TypeDir, Mode: 0755}, "swap/a": reg,
+	}
+
+	delta, err := NewDeltaLayer(files, dir, tarhelper.Options{}, checksums, entries)
+	require.NoError(t, err)
+	assert.Equal(t, 5, delta.Files())
+	assert.Equal(t, 4, delta.Deleted())
+
+	rc, err := delta.Uncompressed()
+	require.NoError(t, err)
+	defer rc.Close()
+	names := []string{}
+	require.NoError(t, tarhelper.WalkTar(rc, func(header *tar.Header, fi os.FileInfo, r io.Reader) (bool, error) {
+		names = append(names, header.Name)
+		return false, nil
+	}))
+	// a mode or a symlink target changed is archived, a directory replaced is whited out
+	assert.Equal(t, []string{".wh.gone", ".wh.olddir", ".wh.oldlink", ".wh.swap", "added", "changed", "exec", "link", "swap"}, names)
+
+	deltaChecksums, err := delta.Checksums()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"same": sum("same"), "changed": sum("new"), "added": sum("added"), "exec": sum("exec")}, deltaChecksums)
+	count, size, err := delta.RegularFiles()
+	require.NoError(t, err)
+	assert.Equal(t, 4, count)
+	assert.EqualValues(t, 16, size)
+	deltaEntries, err := delta.Entries()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"added", "changed", "exec", "keep", "link", "same", "swap"}, slices.Sorted(maps.Keys(deltaEntries)))
+	assert.Equal(t, EntryMeta{Type: tar.TypeReg, Mode: 0755}, deltaEntries["exec"])
+	assert.Equal(t, EntryMeta{Type: tar.TypeSymlink, Mode: 0777, Linkname: "same"}, deltaEntries["swap"])
+}
+
+func TestNewDeltaLayer_Hardlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	dir := t.TempDir()
+	x, y, z := filepath.Join(dir, "x"), filepath.Join(dir, "y"), filepath.Join(dir, "z")
+	require.NoError(t, os.WriteFile(x, []byte("same"), 0644))
+	require.NoError(t, os.Link(x, y))
+	require.NoError(t, os.WriteFile(z, []byte("z"), 0644))
+	files := map[string]string{"x": x, "y": y, "z": z}
+	full, err := NewTarLayer(files, dir, tarhelper.Options{})
+	require.NoError(t, err)
+	checksums, err := full.Checksums()
+	require.NoError(t, err)
+	entries, err := full.Entries()
+	require.NoError(t, err)
+	require.Equal(t, byte(tar.TypeLink), entries["y"].Type)
+
+	// an unchanged hard link is not archived again
+	delta, err := NewDeltaLayer(files, dir, tarhelper.Options{}, checksums, entries)
+	require.NoError(t, err)
+	assert.True(t, delta.Empty())
+
+	// nor kept once the file it links to is deleted
+	delete(files, "x")
+	delta, err = NewDeltaLayer(files, dir, tarhelper.Options{}, checksums, entries)
+	require.NoError(t, err)
+	assert.Equal(t, 1, delta.Files())
+	assert.Equal(t, 1, delta.Deleted())
+}
+
+func TestChecksums(t *testing.T) {
+	checksums := map[string]string{}
+	for _, name := range []string{"plain", "a b", "  lead", "new\nline", `"quoted"`, `back\slash`} {
+		checksums[name] = strings.Repeat("0", 64)
+	}
+	var buf bytes.Buffer
+	require.NoError(t, WriteChecksums(&buf, checksums))
+	assert.Contains(t, buf.String(), strings.Repeat("0", 64)+"  plain\n")
+	read, err := ReadChecksums(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, checksums, read)
+}
+
+func TestEntries(t *testing.T) {
+	entries := map[string]EntryMeta{
+		"a b":      {Type: tar.TypeReg, Mode: 0644},
+		"dir":      {Type: tar.TypeDir, Mode: 0755},
+		"l\"\n":    {Type: tar.TypeSymlink, Mode: 0777, Linkname: "a b"},
+		"dir/hard": {Type: tar.TypeLink, Linkname: "a b"},
+	}
+	var buf bytes.Buffer
+	require.NoError(t, WriteEntries(&buf, entries))
+	read, err := ReadEntries(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, entries, read)
+
+	_, err = ReadEntries(strings.NewReader("0 644 a\n"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,222 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// CracMeta is written as meta.yaml into the meta layer, fields are optional when reading
+// since cache images pushed by older versions only have some of them.
+type CracMeta struct {
+	Version  string    `yaml:"version,omitempty" json:"version,omitempty"`
+	Keys     []string  `yaml:"keys,omitempty" json:"keys,omitempty"`
+	Platform string    `yaml:"platform,omitempty" json:"platform,omitempty"`
+	DepFiles []DepFile `yaml:"depFiles,omitempty" json:"depFiles,omitempty"`
+	// Hash is the untruncated hash the tag is made of, HashScheme tells how it is computed,
+	// HashSchemeV1 if empty.
+	Hash       string `yaml:"hash,omitempty" json:"hash,omitempty"`
+	HashScheme string `yaml:"hashScheme,omitempty" json:"hashScheme,omitempty"`
+	// Files and Size count regular files in the cache layer.
+	Files    int     `yaml:"files,omitempty" json:"files,omitempty"`
+	Size     int64   `yaml:"size,omitempty" json:"size,omitempty"`
+	Hostname string  `yaml:"hostname,omitempty" json:"hostname,omitempty"`
+	CI       *CIMeta `yaml:"ci,omitempty" json:"ci,omitempty"`
+	// Base is the tag of the cache image the last delta layer is stacked on, Depth counts delta
+	// layers, both are empty for a full cache image.
+	Base  string `yaml:"base,omitempty" json:"base,omitempty"`
+	Depth int    `yaml:"depth,omitempty" json:"depth,omitempty"`
+}
+
+// HashSchemeOrDefault returns the hash scheme, HashSchemeV1 if it is not recorded.
+func (m *CracMeta) HashSchemeOrDefault() string {
+	if len(m.HashScheme) == 0 {
+		return HashSchemeV1
+	}
+	return m.HashScheme
+}
+
+// RecordsInputs tells whether dep files are recorded, which cache images pushed by older versions
+// lack. Tagged pushes leave the hash empty, so it is decided by any field those versions never set.
+func (m *CracMeta) RecordsInputs() bool {
+	return len(m.Hash) != 0 || len(m.DepFiles) != 0 || m.Files != 0 || len(m.Hostname) != 0 || m.CI != nil || len(m.Base) != 0
+}
+
+// DefaultMaxDepth caps delta layers stacked on a full cache image, a cache image beyond it is
+// compacted into full layers.
+const DefaultMaxDepth = 8
+
+type DepFile struct {
+	Path   string `yaml:"path" json:"path"`
+	Sha256 string `yaml:"sha256" json:"sha256"`
+}
+
+// CIMeta tells which CI pipeline pushed a cache image.
+type CIMeta struct {
+	Provider    string `yaml:"provider,omitempty" json:"provider,omitempty"`
+	Commit      string `yaml:"commit,omitempty" json:"commit,omitempty"`
+	Branch      string `yaml:"branch,omitempty" json:"branch,omitempty"`
+	PipelineURL string `yaml:"pipelineUrl,omitempty" json:"pipelineUrl,omitempty"`
+}
+
+// ChecksumsFile is the per-file checksum manifest next to meta.yaml, in the format of sha256sum.
+const ChecksumsFile = "sha256sums"
+
+// ReadCI reads CI provenance from environment variables of GitHub Actions, GitLab CI or any CI
+// setting CI_COMMIT_SHA, nil if none is found.
+func ReadCI() *CIMeta {
+	switch {
+	case len(os.Getenv("GITHUB_ACTIONS")) != 0:
+		ci := &CIMeta{
+			Provider: "github",
+			Commit:   os.Getenv("GITHUB_SHA"),
+			Branch:   os.Getenv("GITHUB_HEAD_REF"),
+		}
+		if len(ci.Branch) == 0 {
+			ci.Branch = os.Getenv("GITHUB_REF_NAME")
+		}
+		server, repo, run := os.Getenv("GITHUB_SERVER_URL"), os.Getenv("GITHUB_REPOSITORY"), os.Getenv("GITHUB_RUN_ID")
+		if len(server) != 0 && len(repo) != 0 && len(run) != 0 {
+			ci.PipelineURL = fmt.Sprintf("%s/%s/actions/runs/%s", server, repo, run)
+		}
+		return ci
+
+	case len(os.Getenv("GITLAB_CI")) != 0, len(os.Getenv("CI_COMMIT_SHA")) != 0:
+		ci := &CIMeta{
+			Commit:      os.Getenv("CI_COMMIT_SHA"),
+			Branch:      os.Getenv("CI_COMMIT_REF_NAME"),
+			PipelineURL: os.Getenv("CI_PIPELINE_URL"),
+		}
+		if len(os.Getenv("GITLAB_CI")) != 0 {
+			ci.Provider = "gitlab"
+		}
+		return ci
+	}
+	return nil
+}
+
+// WriteChecksums writes checksums in the format of sha256sum, sorted by name, a name which is
+// not printable as is is quoted.
+func WriteChecksums(w io.Writer, checksums map[string]string) error {
+	bw := bufio.NewWriter(w)
+	for _, name := range slices.Sorted(maps.Keys(checksums)) {
+		if _, err := fmt.Fprintf(bw, "%s  %s\n", checksums[name], quoteName(name)); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// quoteName quotes name like WriteEntries if it is not printable as is, a name starting with a
+// quote is quoted as well so reading tells them apart.
+func quoteName(name string) string {
+	quoted := strconv.Quote(name)
+	if quoted[1:len(quoted)-1] == name && !strings.HasPrefix(name, `"`) {
+		return name
+	}
+	return quoted
+}
+
+// ReadChecksums is the reverse of WriteChecksums.
+func ReadChecksums(r io.Reader) (map[string]string, error) {
+	checksums := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) == 0 {
+			continue
+		}
+		sum, name, ok := strings.Cut(line, "  ")
+		if !ok || len(sum) != 64 {
+			return nil, fmt.Errorf("checksum line \"%s\" is invalid", line)
+		}
+		if strings.HasPrefix(name, `"`) {
+			unquoted, err := strconv.Unquote(name)
+			if err != nil {
+				return nil, fmt.Errorf("checksum line \"%s\" is invalid, %w", line, err)
+			}
+			name = unquoted
+		}
+		checksums[name] = sum
+	}
+	return checksums, scanner.Err()
+}
+
+// EntriesFile lists every entry of the cache layers next to meta.yaml, so a delta layer tells
+// changed modes, types and symlink targets, and deletes entries other than regular files.
+const EntriesFile = "entries"
+
+// EntryMeta is an entry of the cache layers besides its content, Type is the tar typeflag.
+type EntryMeta struct {
+	Type     byte
+	Mode     int64
+	Linkname string
+}
+
+// WriteEntries writes a line "<type> <mode> <name> <linkname>" per entry in name order, mode is
+// octal, name and linkname are quoted.
+func WriteEntries(w io.Writer, entries map[string]EntryMeta) error {
+	bw := bufio.NewWriter(w)
+	for _, name := range slices.Sorted(maps.Keys(entries)) {
+		e := entries[name]
+		if _, err := fmt.Fprintf(bw, "%c %o %q %q\n", e.Type, e.Mode, name, e.Linkname); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// ReadEntries is the reverse of WriteEntries.
+func ReadEntries(r io.Reader) (map[string]EntryMeta, error) {
+	entries := map[string]EntryMeta{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) == 0 {
+			continue
+		}
+		name, e, err := parseEntry(line)
+		if err != nil {
+			return nil, fmt.Errorf("entry line \"%s\" is invalid, %w", line, err)
+		}
+		entries[name] = e
+	}
+	return entries, scanner.Err()
+}
+
+func parseEntry(line string) (string, EntryMeta, error) {
+	e := EntryMeta{}
+	typeflag, rest, ok := strings.Cut(line, " ")
+	if !ok || len(typeflag) != 1 {
+		return "", e, fmt.Errorf("type is missing")
+	}
+	e.Type = typeflag[0]
+	mode, rest, ok := strings.Cut(rest, " ")
+	if !ok {
+		return "", e, fmt.Errorf("mode is missing")
+	}
+	var err error
+	if e.Mode, err = strconv.ParseInt(mode, 8, 64); err != nil {
+		return "", e, err
+	}
+	quoted, err := strconv.QuotedPrefix(rest)
+	if err != nil {
+		return "", e, err
+	}
+	name, _ := strconv.Unquote(quoted)
+	rest, ok = strings.CutPrefix(rest[len(quoted):], " ")
+	if !ok {
+		return "", e, fmt.Errorf("linkname is missing")
+	}
+	if e.Linkname, err = strconv.Unquote(rest); err != nil {
+		return "", e, err
+	}
+	return name, e, nil
+}
@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/ssuf1998dev/container-registry-as-cache/internal/tarhelper"
+)
+
+const (
+	// SplitNone puts all files into one layer.
+	SplitNone = "none"
+	// SplitDir puts files of each directory at Split.Depth into a layer of its own.
+	SplitDir = "dir"
+	// SplitHash puts files into Split.Layers layers by a hash of their directory at Split.Depth.
+	SplitHash = "hash"
+)
+
+const (
+	DefaultSplitDepth  = 1
+	DefaultSplitLayers = 16
+)
+
+// Split tells how files are partitioned into cache layers. The group of a file is its directory
+// cut to Depth path components, and a directory is grouped as the files in it, so a group is
+// stable across cache versions and changing files of a group only changes its layer.
+type Split struct {
+	Mode   string
+	Depth  int
+	Layers int
+}
+
+func (s Split) group(name string, dir bool) string {
+	depth := s.Depth
+	if depth <= 0 {
+		depth = DefaultSplitDepth
+	}
+	name = path.Clean(name)
+	if !dir {
+		name = path.Dir(name)
+	}
+	if name == "." {
+		return ""
+	}
+	parts := strings.Split(name, "/")
+	return strings.Join(parts[:min(depth, len(parts))], "/")
+}
+
+// NewTarLayers is like NewTarLayer but partitions files into layers by split, layers are in
+// the order of their groups, or their buckets with SplitHash. Hard links across layers are
+// archived as separate copies.
+func NewTarLayers(files map[string]string, workdir string, opts tarhelper.Options, split Split) ([]*TarLayer, error) {
+	all, err := NewTarLayer(files, workdir, opts)
+	if err != nil {
+		return nil, err
+	}
+	layers := split.Layers
+	if layers <= 0 {
+		layers = DefaultSplitLayers
+	}
+
+	groups := map[string]map[string]string{}
+	for name, p := range all.entries {
+		fi, err := os.Lstat(p)
+		if err != nil {
+			return nil, err
+		}
+		var key string
+		switch split.Mode {
+		case "", SplitNone:
+		case SplitDir:
+			key = split.group(name, fi.IsDir())
+		case SplitHash:
+			h := fnv.New32a()
+			h.Write([]byte(split.group(name, fi.IsDir())))
+			key = fmt.Sprintf("%08d", h.Sum32()%uint32(layers))
+		default:
+			return nil, fmt.Errorf("split mode \"%s\" is invalid", split.Mode)
+		}
+		if groups[key] == nil {
+			groups[key] = map[string]string{}
+		}
+		groups[key][name] = p
+	}
+
+	tarLayers := []*TarLayer{}
+	for _, key := range slices.Sorted(maps.Keys(groups)) {
+		tarLayers = append(tarLayers, &TarLayer{entries: groups[key], opts: opts})
+	}
+	if len(tarLayers) == 0 {
+		tarLayers = append(tarLayers, all)
+	}
+	return tarLayers, nil
+}
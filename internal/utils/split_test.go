@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ssuf1998dev/container-registry-as-cache/internal/tarhelper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplit_Group(t *testing.T) {
+	split := Split{Mode: SplitDir, Depth: 2}
+	assert.Equal(t, "", split.group("foo", false))
+	assert.Equal(t, "a", split.group("a/foo", false))
+	assert.Equal(t, "a/b", split.group("a/b/c/foo", false))
+	assert.Equal(t, "a/b", split.group("a/b/c", true))
+	assert.Equal(t, "a", split.group("a/", true))
+}
+
+func TestNewTarLayers(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{}
+	for _, name := range []string{"r", "a/x", "a/y", "b/z"} {
+		p := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, os.WriteFile(p, []byte(name), 0644))
+		files[name] = p
+	}
+
+	layers, err := NewTarLayers(files, dir, tarhelper.Options{}, Split{})
+	require.NoError(t, err)
+	assert.Len(t, layers, 1)
+
+	layers, err = NewTarLayers(files, dir, tarhelper.Options{}, Split{Mode: SplitDir})
+	require.NoError(t, err)
+	require.Len(t, layers, 3)
+	assert.Equal(t, []int{1, 2, 1}, []int{layers[0].Files(), layers[1].Files(), layers[2].Files()})
+
+	layers, err = NewTarLayers(files, dir, tarhelper.Options{}, Split{Mode: SplitHash, Layers: 1})
+	require.NoError(t, err)
+	assert.Len(t, layers, 1)
+
+	_, err = NewTarLayers(files, dir, tarhelper.Options{}, Split{Mode: "size"})
+	assert.Error(t, err)
+}
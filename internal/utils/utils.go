@@ -6,43 +6,148 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/bmatcuk/doublestar/v4"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 )
 
-type CracMeta struct {
-	Version string `yaml:"version,omitempty"`
+const (
+	// HashSchemeV1 hashes contents of dep files and keys.
+	HashSchemeV1 = "v1"
+	// HashSchemeV2 hashes relative paths of dep files as well.
+	HashSchemeV2 = "v2"
+	// DefaultHashScheme stays HashSchemeV1, so existing cache images keep matching.
+	DefaultHashScheme = HashSchemeV1
+)
+
+// DefaultTagLength is the count of hex characters of the hash kept in tags.
+const DefaultTagLength = 8
+
+// tag must match [a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}
+const tagMaxLength = 128
+
+var tagInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// NormalizeTagPrefix replaces characters that are not allowed in a tag with "-".
+func NormalizeTagPrefix(prefix string) string {
+	return tagInvalidChars.ReplaceAllString(prefix, "-")
+}
+
+// JoinTag makes a tag looks like "<prefix>-<hash>", or "<hash>" if prefix is empty.
+func JoinTag(prefix string, hash string) string {
+	prefix = strings.Trim(NormalizeTagPrefix(prefix), "-.")
+	if len(prefix) == 0 {
+		return hash
+	}
+	if maxLength := tagMaxLength - len(hash) - 1; len(prefix) > maxLength {
+		prefix = prefix[:maxLength]
+	}
+	return fmt.Sprintf("%s-%s", prefix, hash)
+}
+
+// TagScheme returns the hash scheme of a tag made by JoinTag, the hash of HashSchemeV1 has
+// no scheme, and the one of a later scheme starts with it, like "v2a1b2c3d4". The hex of
+// hashes never has a "v", and scheme versions are single digits.
+func TagScheme(tag string) string {
+	_, hash := SplitTag(tag)
+	if len(hash) > 2 && hash[0] == 'v' && hash[1] >= '2' && hash[1] <= '9' {
+		return hash[:2]
+	}
+	return HashSchemeV1
 }
 
+// SplitTag is the reverse of JoinTag, the prefix is also known as the key scope.
+func SplitTag(tag string) (prefix string, hash string) {
+	i := strings.LastIndex(tag, "-")
+	if i < 0 {
+		return "", tag
+	}
+	return tag[:i], tag[i+1:]
+}
+
+// ComputeTag returns the first DefaultTagLength characters of ComputeHash with HashSchemeV1,
+// or "latest" if there is nothing to hash.
 func ComputeTag(files map[string]string, keys []string, workdir string) (string, error) {
-	tag := name.DefaultTag
-	hashes := []string{}
+	hash, err := ComputeHash(HashSchemeV1, files, keys, workdir)
+	if err != nil || len(hash) == 0 {
+		return name.DefaultTag, err
+	}
+	return hash[0:DefaultTagLength], nil
+}
 
-	for _, f := range files {
-		b, err := os.ReadFile(PathJoinRespectAbs(workdir, f))
-		if err != nil {
-			return "", err
+// ComputeHash returns the hex sha256 of dep files and keys, it is empty if both are empty.
+//
+// With HashSchemeV1, only contents of dep files and keys are hashed, so renaming a dep file
+// keeps the hash. With HashSchemeV2, relative paths of dep files are hashed as well, and dep
+// files and keys are told apart.
+func ComputeHash(scheme string, files map[string]string, keys []string, workdir string) (string, error) {
+	if scheme != HashSchemeV1 && scheme != HashSchemeV2 {
+		return "", fmt.Errorf("hash scheme \"%s\" is invalid", scheme)
+	}
+	lines := []string{}
+
+	depFiles, err := HashDepFiles(files, workdir)
+	if err != nil {
+		return "", err
+	}
+	for _, f := range depFiles {
+		if scheme == HashSchemeV1 {
+			lines = append(lines, f.Sha256)
+		} else {
+			lines = append(lines, fmt.Sprintf("file %s %s", f.Sha256, f.Path))
 		}
-		// b = append(fmt.Appendf(nil, "%s\n", filepath.Base(f)), b...)
-		hashes = append(hashes, fmt.Sprintf("%x", sha256.Sum256(b)))
 	}
 
 	for _, k := range keys {
-		hashes = append(hashes, fmt.Sprintf("%x", sha256.Sum256([]byte(k))))
+		if scheme == HashSchemeV1 {
+			lines = append(lines, fmt.Sprintf("%x", sha256.Sum256([]byte(k))))
+		} else {
+			lines = append(lines, fmt.Sprintf("key %x", sha256.Sum256([]byte(k))))
+		}
 	}
 
-	sort.Strings(hashes)
-
-	if len(hashes) != 0 {
-		hash := sha256.Sum256([]byte(strings.Join(hashes, "\n")))
-		tag = hex.EncodeToString(hash[:])[0:8]
+	if len(lines) == 0 {
+		return "", nil
+	}
+	sort.Strings(lines)
+	if scheme == HashSchemeV2 {
+		lines = append([]string{HashSchemeV2}, lines...)
 	}
+	hash := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(hash[:]), nil
+}
 
-	return tag, nil
+// HashDepFiles returns the sha256 of each dep file, sorted by path. Paths are relative to
+// workdir, or the current directory if workdir is empty, in slashes.
+func HashDepFiles(files map[string]string, workdir string) ([]DepFile, error) {
+	base, err := filepath.Abs(workdir)
+	if err != nil {
+		return nil, err
+	}
+	depFiles := []DepFile{}
+	for _, f := range files {
+		path, err := filepath.Abs(PathJoinRespectAbs(workdir, f))
+		if err != nil {
+			return nil, err
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if rel, err := filepath.Rel(base, path); err == nil {
+			path = rel
+		}
+		depFiles = append(depFiles, DepFile{Path: filepath.ToSlash(path), Sha256: fmt.Sprintf("%x", sha256.Sum256(b))})
+	}
+	slices.SortFunc(depFiles, func(a, b DepFile) int { return strings.Compare(a.Path, b.Path) })
+	return depFiles, nil
 }
 
 func ScanFiles(patterns []string) map[string]string {
@@ -65,6 +170,45 @@ func ScanFiles(patterns []string) map[string]string {
 	return m
 }
 
+// ScanEntries is like ScanFiles but directories are matched as well,
+// symlinks are kept as entries rather than traversed unless followSymlinks.
+func ScanEntries(patterns []string, followSymlinks bool) map[string]string {
+	opts := []doublestar.GlobOption{}
+	if !followSymlinks {
+		opts = append(opts, doublestar.WithNoFollow())
+	}
+	m := map[string]string{}
+	for _, item := range patterns {
+		basepath, pattern := doublestar.SplitPattern(filepath.ToSlash(item))
+		fsys := os.DirFS(basepath)
+		matches, err := doublestar.Glob(fsys, pattern, opts...)
+		if err != nil {
+			continue
+		}
+		for _, match := range matches {
+			if match == "." {
+				continue
+			}
+			abs, err := filepath.Abs(filepath.Join(basepath, match))
+			if err != nil {
+				continue
+			}
+			m[match] = abs
+		}
+	}
+	return m
+}
+
+// SourceDateEpoch returns the time in SOURCE_DATE_EPOCH, in seconds since the Unix epoch,
+// ok is false if it is not set or invalid.
+func SourceDateEpoch() (t time.Time, ok bool) {
+	sec, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(sec, 0).UTC(), true
+}
+
 func PathJoinRespectAbs(elem ...string) string {
 	for _, item := range elem[1:] {
 		if filepath.IsAbs(item) {
@@ -1,9 +1,11 @@
 package utils
 
 import (
+	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -53,3 +55,64 @@ func TestPathJoinRespectAbs_Unix(t *testing.T) {
 		assert.Equal(t, item.path, PathJoinRespectAbs(item.elem...))
 	}
 }
+
+func TestJoinTag(t *testing.T) {
+	for _, item := range []struct {
+		prefix string
+		hash   string
+		tag    string
+	}{
+		{prefix: "", hash: "bd142ccf", tag: "bd142ccf"},
+		{prefix: "pnpm", hash: "bd142ccf", tag: "pnpm-bd142ccf"},
+		{prefix: "pnpm/linux amd64", hash: "bd142ccf", tag: "pnpm-linux-amd64-bd142ccf"},
+		{prefix: "-pnpm-", hash: "bd142ccf", tag: "pnpm-bd142ccf"},
+	} {
+		tag := JoinTag(item.prefix, item.hash)
+		assert.Equal(t, item.tag, tag)
+		prefix, hash := SplitTag(tag)
+		assert.Equal(t, item.hash, hash)
+		assert.Equal(t, strings.Trim(NormalizeTagPrefix(item.prefix), "-"), prefix)
+	}
+}
+
+func TestComputeHash(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a"), []byte("same"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "b"), []byte("same"), 0644))
+
+	hashes := map[string][]string{}
+	for _, scheme := range []string{HashSchemeV1, HashSchemeV2} {
+		for _, files := range []map[string]string{
+			{"a": "a"},
+			{"b": "b"},
+		} {
+			hash, err := ComputeHash(scheme, files, []string{"key"}, dir)
+			require.NoError(t, err)
+			assert.Len(t, hash, 64)
+			hashes[scheme] = append(hashes[scheme], hash)
+		}
+	}
+	// renaming a dep file only changes the hash of v2
+	assert.Equal(t, hashes[HashSchemeV1][0], hashes[HashSchemeV1][1])
+	assert.NotEqual(t, hashes[HashSchemeV2][0], hashes[HashSchemeV2][1])
+	assert.NotEqual(t, hashes[HashSchemeV1][0], hashes[HashSchemeV2][0])
+
+	tag, err := ComputeTag(map[string]string{"a": "a"}, []string{"key"}, dir)
+	require.NoError(t, err)
+	assert.Equal(t, hashes[HashSchemeV1][0][:DefaultTagLength], tag)
+
+	hash, err := ComputeHash(HashSchemeV2, nil, nil, dir)
+	require.NoError(t, err)
+	assert.Empty(t, hash)
+	_, err = ComputeHash("v0", nil, nil, dir)
+	require.Error(t, err)
+}
+
+func TestTagScheme(t *testing.T) {
+	assert.Equal(t, HashSchemeV1, TagScheme("bd142ccf"))
+	assert.Equal(t, HashSchemeV1, TagScheme("pnpm-bd142ccf"))
+	assert.Equal(t, HashSchemeV1, TagScheme("latest"))
+	assert.Equal(t, HashSchemeV2, TagScheme("v2bd142ccf"))
+	assert.Equal(t, HashSchemeV2, TagScheme("pnpm-v2-v2bd142ccf"))
+	assert.Equal(t, HashSchemeV1, TagScheme("pnpm-v2"))
+}